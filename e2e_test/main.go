@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 	"time"
 
@@ -21,19 +23,27 @@ func main() {
 	ctx := context.Background()
 	eg, ctx := errgroup.WithContext(ctx)
 	chInterrupt := make(chan struct{})
+	chLaunchURL := make(chan string, 1)
 	eg.Go(func() error {
 		defer close(chInterrupt)
-		return runBrowser(ctx)
+		select {
+		case launchURL := <-chLaunchURL:
+			return runBrowser(ctx, launchURL)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	})
 	eg.Go(func() error {
-		return runKauthproxy(chInterrupt)
+		return runKauthproxy(chInterrupt, chLaunchURL)
 	})
 	if err := eg.Wait(); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func runKauthproxy(chInterrupt <-chan struct{}) error {
+var launchURLPattern = regexp.MustCompile(`Please open (\S+) in the browser`)
+
+func runKauthproxy(chInterrupt <-chan struct{}, chLaunchURL chan<- string) error {
 	c := exec.Command("output/kauthproxy",
 		"--namespace=kube-system",
 		"--user=tester",
@@ -41,11 +51,28 @@ func runKauthproxy(chInterrupt <-chan struct{}) error {
 		"http://headlamp.svc",
 	)
 	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
+	stderr, err := c.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("could not open stderr of the process: %w", err)
+	}
 	if err := c.Start(); err != nil {
 		return fmt.Errorf("could not start a process: %w", err)
 	}
 	log.Printf("started %s", c.String())
+	// find the launch URL in the output
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			_, _ = fmt.Fprintln(os.Stderr, line)
+			if m := launchURLPattern.FindStringSubmatch(line); m != nil {
+				select {
+				case chLaunchURL <- m[1]:
+				default:
+				}
+			}
+		}
+	}()
 	<-chInterrupt
 	if err := c.Process.Signal(os.Interrupt); err != nil {
 		return fmt.Errorf("could not send SIGINT to the process: %w", err)
@@ -56,7 +83,7 @@ func runKauthproxy(chInterrupt <-chan struct{}) error {
 	return nil
 }
 
-func runBrowser(ctx context.Context) error {
+func runBrowser(ctx context.Context, launchURL string) error {
 	execOpts := chromedp.DefaultExecAllocatorOptions[:]
 	execOpts = append(execOpts, chromedp.NoSandbox)
 	ctx, cancel := chromedp.NewExecAllocator(ctx, execOpts...)
@@ -67,8 +94,10 @@ func runBrowser(ctx context.Context) error {
 	defer cancel()
 	err := chromedp.Run(ctx,
 		chromedp.EmulateViewport(2048, 1152),
+		// start a session
+		navigate(launchURL),
 		// open the page of pod list
-		navigate("http://localhost:18000/c/main/pods"),
+		navigate("http://127.0.0.1:18000/c/main/pods"),
 		// wait for a link on the page
 		chromedp.WaitReady(`a[href='/c/main/namespaces/kube-system']`, chromedp.ByQuery),
 		takeScreenshot("output/screenshot.png"),
@@ -2,21 +2,29 @@ package authproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/cenkalti/backoff/v5"
 	"github.com/google/wire"
 	"github.com/int128/kauthproxy/internal/browser"
-	"github.com/int128/kauthproxy/internal/env"
+	"github.com/int128/kauthproxy/internal/certificate"
 	"github.com/int128/kauthproxy/internal/logger"
 	"github.com/int128/kauthproxy/internal/portforwarder"
 	"github.com/int128/kauthproxy/internal/resolver"
 	"github.com/int128/kauthproxy/internal/reverseproxy"
 	"github.com/int128/kauthproxy/internal/transport"
+	"golang.org/x/oauth2"
 	"golang.org/x/sync/errgroup"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/rest"
@@ -29,28 +37,163 @@ var Set = wire.NewSet(
 
 type Interface interface {
 	Do(ctx context.Context, in Option) error
+	DoAll(ctx context.Context, in []Option) error
 }
 
 var errPortForwarderConnectionLost = errors.New("connection lost")
 
 // AuthProxy provides a use-case of authentication proxy.
 type AuthProxy struct {
-	ReverseProxy    reverseproxy.Interface
-	PortForwarder   portforwarder.Interface
-	ResolverFactory resolver.FactoryInterface
-	NewTransport    transport.NewFunc
-	Env             env.Interface
-	Browser         browser.Interface
-	Logger          logger.Interface
+	ReverseProxy          reverseproxy.Interface
+	PortForwarder         portforwarder.Interface
+	ResolverFactory       resolver.FactoryInterface
+	NewTransport          transport.NewFunc
+	NewAPIServerTransport transport.NewAPIServerFunc
+	Browser               browser.Interface
+	Certificate           certificate.Interface
+	Logger                logger.Interface
 }
 
+// Mode represents how to reach the target.
+type Mode string
+
+const (
+	// ModePortForward forwards to the pod via the port forwarder.
+	ModePortForward Mode = "port-forward"
+	// ModeServiceProxy forwards to the service or pod via the proxy of the API server.
+	// This does not require pods/portforward permission.
+	ModeServiceProxy Mode = "service-proxy"
+)
+
 // Option represents an option of AuthProxy.
 type Option struct {
-	Config                *rest.Config
-	Namespace             string
+	Config    *rest.Config
+	Namespace string
+	// NamespaceOverridden is true if the namespace is given by the flag
+	NamespaceOverridden   bool
 	TargetURL             *url.URL
 	BindAddressCandidates []string
 	SkipOpenBrowser       bool
+	// OpenPath is the path to open in the browser after login.
+	// Defaults to the top.
+	OpenPath string
+	// Mode defaults to ModePortForward
+	Mode Mode
+	// PortForwardProtocol defaults to portforwarder.ProtocolAuto
+	PortForwardProtocol portforwarder.Protocol
+	// LoadBalance is the number of pods behind the service to distribute requests.
+	// If it is 0 or 1, requests are forwarded to a single pod.
+	LoadBalance int
+	// TLS is the certificate option to serve the reverse proxy over HTTPS.
+	// If nil, it serves over HTTP.
+	TLS *certificate.Option
+	// UpstreamTLS is the option to verify the certificate of the upstream pod.
+	// It is ignored in ModeServiceProxy, because the API server connects to the upstream.
+	UpstreamTLS UpstreamTLSOption
+	// UpstreamToken is the option to provide a token to the upstream instead of the credential of the cluster.
+	UpstreamToken UpstreamTokenOption
+	// CredentialHeader is the header to send the token to the upstream.
+	// It is ignored in ModeServiceProxy, because the API server requires the Authorization header.
+	CredentialHeader transport.CredentialHeaderOption
+	// ReadOnly forwards only the requests which do not change the state.
+	// If nil, it forwards any request.
+	ReadOnly *reverseproxy.ReadOnlyOption
+	// Policy allows or denies a request by the rules.
+	// If nil, it forwards any request.
+	Policy *reverseproxy.Policy
+	// StripHeaders is the headers removed from a request in addition to reverseproxy.DefaultStripHeaders.
+	StripHeaders []string
+	// Routes is the routes to the targets by the path prefix behind a single reverse proxy.
+	// If set, TargetURL and LoadBalance are ignored.
+	// It is supported only in ModePortForward.
+	Routes []Route
+	// VirtualHost serves the services on NAME.NAMESPACE.localhost behind a single reverse proxy.
+	// If set, TargetURL and LoadBalance are ignored.
+	// It is supported only in ModePortForward.
+	VirtualHost *VirtualHostOption
+	// ForwardProxy serves as a forward proxy to the services, i.e. NAME.NAMESPACE.svc.
+	// If set, TargetURL and LoadBalance are ignored.
+	// It is supported only in ModePortForward.
+	ForwardProxy bool
+
+	// onReady is called with the launch URL when the reverse proxy is ready.
+	// If set, it does not print the launch URL.
+	onReady func(launchURL string)
+	// tlsCertificate is the certificate shared by the targets.
+	// If nil, it loads the certificate of TLS.
+	tlsCertificate *tls.Certificate
+	// tokenSource is the token source shared by the targets.
+	// If nil, it creates a token source of UpstreamToken.
+	tokenSource oauth2.TokenSource
+}
+
+// DoAll runs the use-case for each target in a single lifecycle.
+// Each target has its own port forwarder and reverse proxy.
+// When all reverse proxies are ready, it prints the local URLs and opens the first one in the browser.
+// If any of them fails, it stops all of them.
+//
+// The targets share the certificate and token source of the first option,
+// so that it does not generate the certificate or run the token command for each target.
+//
+// This never returns nil.
+// It returns an error which wraps context.Canceled if the context is canceled.
+func (u *AuthProxy) DoAll(ctx context.Context, options []Option) error {
+	if len(options) == 1 {
+		return u.Do(ctx, options[0])
+	}
+	first := options[0]
+	var cert *tls.Certificate
+	if first.TLS != nil {
+		var err error
+		cert, err = u.Certificate.Load(*first.TLS)
+		if err != nil {
+			return fmt.Errorf("could not load a certificate for the reverse proxy: %w", err)
+		}
+	}
+	ts, err := newSharedTokenSource(first.UpstreamToken)
+	if err != nil {
+		return fmt.Errorf("could not get a token for the upstream: %w", err)
+	}
+	var mu sync.Mutex
+	launchURLs := make([]string, len(options))
+	remaining := len(options)
+	eg, ctx := errgroup.WithContext(ctx)
+	for i, o := range options {
+		o.tlsCertificate = cert
+		o.tokenSource = ts
+		o.SkipOpenBrowser = true
+		o.onReady = func(launchURL string) {
+			mu.Lock()
+			defer mu.Unlock()
+			launchURLs[i] = launchURL
+			remaining--
+			if remaining == 0 {
+				u.printSummary(options, launchURLs)
+				if !first.SkipOpenBrowser {
+					u.openBrowser(launchURLs[0])
+				}
+			}
+		}
+		eg.Go(func() error {
+			if err := u.Do(ctx, o); err != nil {
+				return fmt.Errorf("%s: %w", o.TargetURL, err)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// printSummary prints the table of the targets and local URLs.
+func (u *AuthProxy) printSummary(options []Option, launchURLs []string) {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "TARGET\tURL")
+	for i, o := range options {
+		_, _ = fmt.Fprintf(w, "%s\t%s\n", o.TargetURL, launchURLs[i])
+	}
+	_ = w.Flush()
+	u.Logger.Printf("Please open the following URLs in the browser:\n%s", strings.TrimSuffix(b.String(), "\n"))
 }
 
 // Do runs the use-case.
@@ -59,73 +202,208 @@ type Option struct {
 // This never returns nil.
 // It returns an error which wraps context.Canceled if the context is canceled.
 func (u *AuthProxy) Do(ctx context.Context, o Option) error {
+	if o.Mode == ModeServiceProxy {
+		return u.doServiceProxy(ctx, o)
+	}
 	rsv, err := u.ResolverFactory.New(o.Config)
 	if err != nil {
 		return fmt.Errorf("could not create a resolver: %w", err)
 	}
-	pod, containerPort, err := parseTargetURL(ctx, rsv, o.Namespace, o.TargetURL)
-	if err != nil {
-		return fmt.Errorf("could not find the pod and container port: %w", err)
+	if len(o.Routes) > 0 {
+		return u.doRoutes(ctx, o, rsv)
 	}
-	u.Logger.V(1).Infof("found container port %d of pod %s", containerPort, pod.Name)
-	transitPort, err := u.Env.AllocateLocalPort()
+	if o.VirtualHost != nil {
+		return u.doVirtualHost(ctx, o, rsv)
+	}
+	if o.ForwardProxy {
+		return u.doForwardProxy(ctx, o, rsv)
+	}
+	t, err := parseTargetURL(o.Namespace, o.NamespaceOverridden, o.TargetURL)
 	if err != nil {
-		return fmt.Errorf("could not allocate a local port: %w", err)
+		return fmt.Errorf("invalid target URL: %w", err)
+	}
+	if o.LoadBalance > 1 {
+		return u.doLoadBalance(ctx, o, t, rsv)
 	}
-	rpTransport, err := u.NewTransport(o.Config)
+	b, rpTransport, containerPort, err := u.newBackend(ctx, o, t, rsv)
 	if err != nil {
-		return fmt.Errorf("could not create a transport for reverse proxy: %w", err)
+		return err
 	}
-	u.Logger.V(1).Infof("client -> reverse_proxy -> port_forwarder:%d -> pod -> container:%d", transitPort, containerPort)
+	u.Logger.V(1).Infof("client -> reverse_proxy -> port_forwarder -> pod -> container:%d", containerPort)
 
-	var once sync.Once
 	ro := runOption{
+		backends: []backend{b},
+		reverseProxyOption: reverseproxy.Option{
+			Transport:             rpTransport,
+			BindAddressCandidates: o.BindAddressCandidates,
+			TargetScheme:          o.TargetURL.Scheme,
+			TargetHost:            "localhost",
+			TargetPort:            containerPort,
+			ReadOnly:              o.ReadOnly,
+			Policy:                o.Policy,
+			StripHeaders:          o.StripHeaders,
+		},
+		skipOpenBrowser: o.SkipOpenBrowser,
+		tls:             o.TLS,
+		tlsCertificate:  o.tlsCertificate,
+		onReady:         o.onReady,
+		openPath:        o.OpenPath,
+	}
+	if err := u.run(ctx, ro); err != nil {
+		return fmt.Errorf("error while running an authentication proxy: %w", err)
+	}
+	return nil
+}
+
+// newBackend resolves the pod of the target,
+// and returns the backend and transport to reach the container port via the port forwarder.
+func (u *AuthProxy) newBackend(ctx context.Context, o Option, t target, rsv resolver.Interface) (backend, http.RoundTripper, int, error) {
+	pod, containerPort, err := t.resolve(ctx, rsv)
+	if err != nil {
+		return backend{}, nil, 0, fmt.Errorf("could not find the pod and container port: %w", err)
+	}
+	u.Logger.V(1).Infof("found container port %d of pod %s", containerPort, pod.Name)
+	// the reverse proxy dials to the pod via the port forwarder without any local port
+	to, err := u.newTransportOption(ctx, o, t, rsv)
+	if err != nil {
+		return backend{}, nil, 0, fmt.Errorf("invalid upstream TLS option: %w", err)
+	}
+	d := &dialer{}
+	to.DialContext = d.DialContext
+	rpTransport, err := u.NewTransport(o.Config, to)
+	if err != nil {
+		return backend{}, nil, 0, fmt.Errorf("could not create a transport for reverse proxy: %w", err)
+	}
+	b := backend{
+		dialer: d,
 		portForwarderOption: portforwarder.Option{
 			Config:              o.Config,
-			SourcePort:          transitPort,
 			TargetNamespace:     pod.Namespace,
 			TargetPodName:       pod.Name,
 			TargetContainerPort: containerPort,
+			Protocol:            o.PortForwardProtocol,
 		},
+	}
+	if t.kind != targetKindPod {
+		b.resolve = func(ctx context.Context) (*corev1.Pod, int, error) {
+			return t.resolve(ctx, rsv)
+		}
+	}
+	return b, rpTransport, containerPort, nil
+}
+
+// doServiceProxy runs a reverse proxy to the proxy endpoint of the API server,
+// i.e. /api/v1/namespaces/NAMESPACE/services/SCHEME:NAME:PORT/proxy.
+func (u *AuthProxy) doServiceProxy(ctx context.Context, o Option) error {
+	t, err := parseTargetURL(o.Namespace, o.NamespaceOverridden, o.TargetURL)
+	if err != nil {
+		return fmt.Errorf("invalid target URL: %w", err)
+	}
+	var resource string
+	switch t.kind {
+	case targetKindService:
+		resource = "services"
+	case targetKindPod:
+		resource = "pods"
+		if t.port == 0 {
+			// the API server proxies to port 80 if the port is omitted,
+			// so find the container port in the same way as ModePortForward
+			rsv, err := u.ResolverFactory.New(o.Config)
+			if err != nil {
+				return fmt.Errorf("could not create a resolver: %w", err)
+			}
+			if _, t.port, err = rsv.FindPodByName(ctx, t.namespace, t.name, 0); err != nil {
+				return fmt.Errorf("could not find the pod and container port: %w", err)
+			}
+		}
+	default:
+		return fmt.Errorf("mode %s supports only a service or pod", ModeServiceProxy)
+	}
+	var port string
+	if t.port != 0 {
+		port = strconv.Itoa(t.port)
+	}
+	serverURL, _, err := rest.DefaultServerUrlFor(o.Config)
+	if err != nil {
+		return fmt.Errorf("invalid host of the API server: %w", err)
+	}
+	serverPort, err := parseServerPort(serverURL)
+	if err != nil {
+		return fmt.Errorf("invalid host of the API server: %w", err)
+	}
+	pathPrefix := fmt.Sprintf("%s/api/v1/namespaces/%s/%s/%s:%s:%s/proxy",
+		strings.TrimSuffix(serverURL.Path, "/"), t.namespace, resource, o.TargetURL.Scheme, t.name, port)
+	rpTransport, err := u.NewAPIServerTransport(o.Config)
+	if err != nil {
+		return fmt.Errorf("could not create a transport for reverse proxy: %w", err)
+	}
+	u.Logger.V(1).Infof("client -> reverse_proxy -> api_server%s -> %s", pathPrefix, t.name)
+
+	ro := runOption{
 		reverseProxyOption: reverseproxy.Option{
 			Transport:             rpTransport,
 			BindAddressCandidates: o.BindAddressCandidates,
-			TargetScheme:          o.TargetURL.Scheme,
-			TargetHost:            "localhost",
-			TargetPort:            transitPort,
+			TargetScheme:          serverURL.Scheme,
+			TargetHost:            serverURL.Hostname(),
+			TargetPort:            serverPort,
+			TargetPathPrefix:      pathPrefix,
+			ReadOnly:              o.ReadOnly,
+			Policy:                o.Policy,
+			StripHeaders:          o.StripHeaders,
 		},
 		skipOpenBrowser: o.SkipOpenBrowser,
-		onceOpenBrowser: &once,
+		tls:             o.TLS,
+		tlsCertificate:  o.tlsCertificate,
+		onReady:         o.onReady,
+		openPath:        o.OpenPath,
 	}
-	b := backoff.NewExponentialBackOff()
-	_, err = backoff.Retry(ctx, func() (struct{}, error) {
-		if err := u.run(ctx, ro); err != nil {
-			if errors.Is(err, errPortForwarderConnectionLost) {
-				u.Logger.Printf("retrying: %s", err)
-				return struct{}{}, err
-			}
-			return struct{}{}, backoff.Permanent(err)
-		}
-		return struct{}{}, nil
-	}, backoff.WithBackOff(b))
-	if err != nil {
-		return fmt.Errorf("retry over: %w", err)
+	if err := u.run(ctx, ro); err != nil {
+		return fmt.Errorf("error while running an authentication proxy: %w", err)
 	}
 	return nil
 }
 
-type runOption struct {
+func parseServerPort(u *url.URL) (int, error) {
+	if u.Port() != "" {
+		return strconv.Atoi(u.Port())
+	}
+	if u.Scheme == "http" {
+		return 80, nil
+	}
+	return 443, nil
+}
+
+// backend represents a port forwarder to a pod and the dialer bound to it.
+type backend struct {
+	dialer              *dialer
 	portForwarderOption portforwarder.Option
-	reverseProxyOption  reverseproxy.Option
-	skipOpenBrowser     bool
-	onceOpenBrowser     *sync.Once
+	// resolve returns the pod and container port to reconnect.
+	// If nil, it reconnects to the same pod.
+	resolve func(ctx context.Context) (*corev1.Pod, int, error)
 }
 
-// run runs a port forwarder and reverse proxy, and waits for them, as follows:
+type runOption struct {
+	// if empty, it runs only the reverse proxy
+	backends           []backend
+	reverseProxyOption reverseproxy.Option
+	skipOpenBrowser    bool
+	tls                *certificate.Option
+	onReady            func(launchURL string)
+	openPath           string
+	// if set, it is used instead of loading the certificate of tls
+	tlsCertificate *tls.Certificate
+	// if true, it shows how to set the forward proxy instead of opening the browser
+	forwardProxy bool
+}
+
+// run runs port forwarders and reverse proxy, and waits for them, as follows:
+//
+//  1. Run the port forwarders.
+//  2. When the first port forwarder is ready, run a reverse proxy.
+//  3. When the reverse proxy is ready, open the browser.
 //
-//  1. Run a port forwarder.
-//  2. When the port forwarder is ready, run a reverse proxy.
-//  3. When the reverse proxy is ready, open the browser (only first time).
+// If the connection of the port forwarder has lost, it retries the port forwarder.
+// The reverse proxy keeps running during the retry, so that the local URL is stable.
 //
 // When the context is canceled,
 //
@@ -134,34 +412,41 @@ type runOption struct {
 //
 // This never returns nil.
 // It returns an error which wraps context.Canceled if the context is canceled.
-// It returns errPortForwarderConnectionLost if a connection has lost.
 func (u *AuthProxy) run(ctx context.Context, o runOption) error {
+	if o.tls != nil {
+		cert := o.tlsCertificate
+		if cert == nil {
+			var err error
+			cert, err = u.Certificate.Load(*o.tls)
+			if err != nil {
+				return fmt.Errorf("could not load a certificate for the reverse proxy: %w", err)
+			}
+		}
+		o.reverseProxyOption.TLSCertificate = cert
+	}
+	loginCode, err := reverseproxy.NewLoginCode()
+	if err != nil {
+		return fmt.Errorf("could not generate a login code: %w", err)
+	}
+	o.reverseProxyOption.LoginCode = loginCode
 	portForwarderIsReady := make(chan struct{})
 	reverseProxyIsReady := make(chan reverseproxy.Instance, 1)
-	stopPortForwarder := make(chan struct{})
 	defer close(reverseProxyIsReady)
 
 	eg, ctx := errgroup.WithContext(ctx)
-	// start a port forwarder
-	eg.Go(func() error {
-		u.Logger.V(1).Infof("starting a port forwarder")
-		if err := u.PortForwarder.Run(o.portForwarderOption, portForwarderIsReady, stopPortForwarder); err != nil {
-			return fmt.Errorf("could not run a port forwarder: %w", err)
-		}
-		u.Logger.V(1).Infof("stopped the port forwarder")
-		if ctx.Err() == nil {
-			u.Logger.V(1).Infof("connection of the port forwarder has lost")
-			return errPortForwarderConnectionLost
+	if len(o.backends) == 0 {
+		close(portForwarderIsReady)
+	}
+	for i, b := range o.backends {
+		readyChan := portForwarderIsReady
+		if i > 0 {
+			readyChan = make(chan struct{})
 		}
-		return nil
-	})
-	// stop the port forwarder when the context is done
-	eg.Go(func() error {
-		<-ctx.Done()
-		u.Logger.V(1).Infof("stopping the port forwarder")
-		close(stopPortForwarder)
-		return fmt.Errorf("context canceled while running the port forwarder: %w", ctx.Err())
-	})
+		// start a port forwarder and retry it when the connection has lost
+		eg.Go(func() error {
+			return u.runPortForwarderWithRetry(ctx, b, readyChan)
+		})
+	}
 	// start a reverse proxy when the port forwarder is ready
 	eg.Go(func() error {
 		select {
@@ -183,16 +468,20 @@ func (u *AuthProxy) run(ctx context.Context, o runOption) error {
 		select {
 		case rp := <-reverseProxyIsReady:
 			u.Logger.V(1).Infof("the reverse proxy is ready")
-			rpURL := rp.URL().String()
-			if o.skipOpenBrowser {
-				u.Logger.Printf("Please open %s in the browser", rpURL)
-			} else {
-				o.onceOpenBrowser.Do(func() {
-					u.Logger.V(1).Infof("opening %s in the browser", rpURL)
-					if err := u.Browser.Open(rpURL); err != nil {
-						u.Logger.Printf("Please open %s in the browser (could not open the browser: %s)", rpURL, err)
-					}
-				})
+			baseURL := rp.URL()
+			rpURL := launchURL(baseURL, loginCode, o.openPath)
+			switch {
+			case o.forwardProxy:
+				u.printForwardProxy(baseURL, loginCode)
+			case o.skipOpenBrowser:
+				if o.onReady == nil {
+					u.Logger.Printf("Please open %s in the browser", rpURL)
+				}
+			default:
+				u.openBrowser(rpURL)
+			}
+			if o.onReady != nil {
+				o.onReady(rpURL)
 			}
 			// shutdown the reverse proxy when the context is done
 			eg.Go(func() error {
@@ -209,17 +498,287 @@ func (u *AuthProxy) run(ctx context.Context, o runOption) error {
 			return fmt.Errorf("context canceled before reverse proxy is ready: %w", ctx.Err())
 		}
 	})
-	if err := eg.Wait(); err != nil {
-		return fmt.Errorf("error while running an authentication proxy: %w", err)
+	return eg.Wait()
+}
+
+// openBrowser opens the launch URL in the browser.
+// If it could not open the browser, it shows the URL instead.
+func (u *AuthProxy) openBrowser(launchURL string) {
+	u.Logger.V(1).Infof("opening the browser")
+	if err := u.Browser.Open(launchURL); err != nil {
+		u.Logger.Printf("Please open %s in the browser (could not open the browser: %s)", launchURL, err)
 	}
-	return nil
 }
 
-func parseTargetURL(ctx context.Context, r resolver.Interface, namespace string, u *url.URL) (*corev1.Pod, int, error) {
-	h := u.Hostname()
-	if strings.HasSuffix(h, ".svc") {
-		serviceName := strings.TrimSuffix(h, ".svc")
-		return r.FindPodByServiceName(ctx, namespace, serviceName)
+// forwardProxyUsername is the username of the forward proxy.
+// Any username is accepted, and the login code is the password.
+const forwardProxyUsername = "kauthproxy"
+
+// printForwardProxy shows how to set the forward proxy.
+func (u *AuthProxy) printForwardProxy(baseURL *url.URL, password string) {
+	proxyURL := *baseURL
+	proxyURL.User = url.UserPassword(forwardProxyUsername, password)
+	u.Logger.Printf("Please set the HTTP proxy, e.g. export http_proxy=%s", &proxyURL)
+	u.Logger.Printf("For the browser, set the proxy auto-config URL to %s and log in as %s with the password %s",
+		baseURL.JoinPath(reverseproxy.PACPath), forwardProxyUsername, password)
+}
+
+// launchURL returns the one-time URL to start a session of the reverse proxy.
+// If openPath is set, the browser is redirected to it after login.
+func launchURL(base *url.URL, loginCode, openPath string) string {
+	u := base.JoinPath(reverseproxy.LoginPath)
+	q := url.Values{"code": {loginCode}}
+	if openPath != "" {
+		q.Set("path", openPath)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// portForwarderBackOff returns the backoff to reconnect the port forwarder.
+var portForwarderBackOff = func() backoff.BackOff { return backoff.NewExponentialBackOff() }
+
+// portForwarderRetryMaxElapsedTime is the time limit to reconnect the port forwarder after the connection has lost.
+var portForwarderRetryMaxElapsedTime = backoff.DefaultMaxElapsedTime
+
+// portForwarderReconnectDelay is the wait before the first attempt to reconnect the port forwarder,
+// because the pod may be terminating.
+// It is not included in portForwarderRetryMaxElapsedTime.
+var portForwarderReconnectDelay = backoff.DefaultInitialInterval
+
+// runPortForwarderWithRetry runs a port forwarder and reconnects it when the connection has lost.
+// It closes the readyChan when the port forwarder is ready at first.
+//
+// On retry, it resolves the target again if the target is not a pod,
+// so that it switches to a replacement pod after a rollout.
+//
+// This never returns nil.
+// It returns an error which wraps context.Canceled if the context is canceled.
+func (u *AuthProxy) runPortForwarderWithRetry(ctx context.Context, o backend, readyChan chan struct{}) error {
+	pfo := o.portForwarderOption
+	err := u.runPortForwarder(ctx, pfo, o.dialer, readyChan)
+	if ctx.Err() != nil || !errors.Is(err, errPortForwarderConnectionLost) {
+		return err
+	}
+	u.Logger.Printf("retrying: %s", err)
+	for {
+		// start a new backoff for each outage,
+		// so that the time limit does not include the period while connected
+		if err := u.reconnectPortForwarder(ctx, o, &pfo); err != nil {
+			return fmt.Errorf("retry over: %w", err)
+		}
+	}
+}
+
+// reconnectPortForwarder runs the port forwarder with the backoff until it is ready.
+// It returns nil when the reconnected connection has lost.
+// It returns an error if the retry is over or the context is canceled.
+func (u *AuthProxy) reconnectPortForwarder(ctx context.Context, o backend, pfo *portforwarder.Option) error {
+	select {
+	case <-time.After(portForwarderReconnectDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	_, err := backoff.Retry(ctx, func() (struct{}, error) {
+		if o.resolve != nil {
+			pod, containerPort, err := o.resolve(ctx)
+			if err != nil {
+				u.Logger.Printf("retrying: could not find the pod and container port: %s", err)
+				return struct{}{}, err
+			}
+			if pod.Name != pfo.TargetPodName || containerPort != pfo.TargetContainerPort {
+				u.Logger.Printf("Switching from pod %s:%d to pod %s:%d",
+					pfo.TargetPodName, pfo.TargetContainerPort, pod.Name, containerPort)
+			}
+			pfo.TargetNamespace = pod.Namespace
+			pfo.TargetPodName = pod.Name
+			pfo.TargetContainerPort = containerPort
+		}
+		readyChan := make(chan struct{})
+		err := u.runPortForwarder(ctx, *pfo, o.dialer, readyChan)
+		if ctx.Err() != nil {
+			return struct{}{}, backoff.Permanent(err)
+		}
+		u.Logger.Printf("retrying: %s", err)
+		select {
+		case <-readyChan:
+			// the port forwarder was ready, and then the connection has lost
+			return struct{}{}, nil
+		default:
+			// a replacement pod may not be reachable yet, so retry on any error
+			return struct{}{}, err
+		}
+	}, backoff.WithBackOff(portForwarderBackOff()), backoff.WithMaxElapsedTime(portForwarderRetryMaxElapsedTime))
+	return err
+}
+
+// runPortForwarder runs a port forwarder and waits for it.
+// When the port forwarder is ready, it sets the connection to the dialer and closes the readyChan.
+// When the context is canceled, it shuts down the port forwarder.
+//
+// This never returns nil.
+// It returns an error which wraps context.Canceled if the context is canceled.
+// It returns errPortForwarderConnectionLost if a connection has lost.
+func (u *AuthProxy) runPortForwarder(ctx context.Context, o portforwarder.Option, d *dialer, readyChan chan struct{}) error {
+	portForwarderIsReady := make(chan portforwarder.Connection, 1)
+	stopPortForwarder := make(chan struct{})
+	portForwarderIsDone := make(chan struct{})
+	watcherIsDone := make(chan struct{})
+	defer func() {
+		close(portForwarderIsDone)
+		<-watcherIsDone
+		d.set(nil)
+	}()
+	go func() {
+		defer close(watcherIsDone)
+		for {
+			select {
+			case conn := <-portForwarderIsReady:
+				u.Logger.V(1).Infof("the port forwarder is ready")
+				d.set(conn)
+				close(readyChan)
+			case <-ctx.Done():
+				// stop the port forwarder when the context is done
+				u.Logger.V(1).Infof("stopping the port forwarder")
+				close(stopPortForwarder)
+				return
+			case <-portForwarderIsDone:
+				// the port forwarder may send the connection and return at once,
+				// so close the readyChan if it has been ready
+				select {
+				case <-portForwarderIsReady:
+					u.Logger.V(1).Infof("the port forwarder is ready")
+					close(readyChan)
+				default:
+				}
+				return
+			}
+		}
+	}()
+
+	u.Logger.V(1).Infof("starting a port forwarder")
+	if err := u.PortForwarder.Run(o, portForwarderIsReady, stopPortForwarder); err != nil {
+		return fmt.Errorf("could not run a port forwarder: %w", err)
+	}
+	u.Logger.V(1).Infof("stopped the port forwarder")
+	if ctx.Err() != nil {
+		return fmt.Errorf("context canceled while running the port forwarder: %w", ctx.Err())
+	}
+	u.Logger.V(1).Infof("connection of the port forwarder has lost")
+	return errPortForwarderConnectionLost
+}
+
+var errPortForwarderNotReady = errors.New("port forwarder is not ready")
+
+// dialer dials to the pod via the current connection of the port forwarder.
+// The connection is replaced when the port forwarder is reconnected.
+type dialer struct {
+	mu   sync.RWMutex
+	conn portforwarder.Connection
+}
+
+func (d *dialer) set(conn portforwarder.Connection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conn = conn
+}
+
+func (d *dialer) ready() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.conn != nil
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.RLock()
+	conn := d.conn
+	d.mu.RUnlock()
+	if conn == nil {
+		return nil, errPortForwarderNotReady
+	}
+	return conn.DialContext(ctx, network, address)
+}
+
+type targetKind int
+
+const (
+	targetKindPod targetKind = iota
+	targetKindService
+	targetKindWorkload
+)
+
+// workloadKinds maps a resource type in the host name to the kind of workload.
+var workloadKinds = map[string]resolver.WorkloadKind{
+	"deploy":      resolver.WorkloadKindDeployment,
+	"deployment":  resolver.WorkloadKindDeployment,
+	"sts":         resolver.WorkloadKindStatefulSet,
+	"statefulset": resolver.WorkloadKindStatefulSet,
+	"ds":          resolver.WorkloadKindDaemonSet,
+	"daemonset":   resolver.WorkloadKindDaemonSet,
+}
+
+// target represents a pod, service or workload to forward.
+type target struct {
+	kind         targetKind
+	workloadKind resolver.WorkloadKind
+	namespace    string
+	name         string
+	// port is 0 if not specified
+	port int
+}
+
+// parseTargetURL parses the host of the URL as follows:
+//
+//   - NAME.svc, NAME.NAMESPACE.svc or NAME.NAMESPACE.svc.CLUSTER_DOMAIN is a service.
+//   - deploy.NAME, sts.NAME or ds.NAME is a workload.
+//   - pod.NAME or NAME is a pod.
+//
+// If the host contains a namespace, it takes precedence over the default namespace.
+// It returns an error if the namespace conflicts with the overridden namespace.
+func parseTargetURL(namespace string, namespaceOverridden bool, u *url.URL) (target, error) {
+	var port int
+	if u.Port() != "" {
+		p, err := strconv.Atoi(u.Port())
+		if err != nil {
+			return target{}, fmt.Errorf("invalid port %s: %w", u.Port(), err)
+		}
+		port = p
+	}
+	h := strings.TrimSuffix(u.Hostname(), ".")
+	if labels := strings.Split(h, "."); slices.Contains(labels[1:], "svc") {
+		// the cluster domain after svc is ignored
+		switch svcIndex := slices.Index(labels[1:], "svc") + 1; svcIndex {
+		case 1:
+			return target{kind: targetKindService, namespace: namespace, name: labels[0], port: port}, nil
+		case 2:
+			serviceNamespace := labels[1]
+			if namespaceOverridden && serviceNamespace != namespace {
+				return target{}, fmt.Errorf("namespace %s in the URL conflicts with the namespace %s given by the flag", serviceNamespace, namespace)
+			}
+			return target{kind: targetKindService, namespace: serviceNamespace, name: labels[0], port: port}, nil
+		default:
+			return target{}, fmt.Errorf("service host must be NAME.svc or NAME.NAMESPACE.svc: %s", h)
+		}
+	}
+	if resourceType, name, ok := strings.Cut(h, "."); ok {
+		if workloadKind, ok := workloadKinds[resourceType]; ok {
+			return target{kind: targetKindWorkload, workloadKind: workloadKind, namespace: namespace, name: name, port: port}, nil
+		}
+		if resourceType == "pod" || resourceType == "po" {
+			return target{kind: targetKindPod, namespace: namespace, name: name, port: port}, nil
+		}
+	}
+	return target{kind: targetKindPod, namespace: namespace, name: h, port: port}, nil
+}
+
+// resolve returns the pod and container port of the target.
+func (t target) resolve(ctx context.Context, r resolver.Interface) (*corev1.Pod, int, error) {
+	switch t.kind {
+	case targetKindService:
+		return r.FindPodByServiceName(ctx, t.namespace, t.name, t.port)
+	case targetKindWorkload:
+		return r.FindPodByWorkloadName(ctx, t.namespace, t.workloadKind, t.name, t.port)
+	default:
+		return r.FindPodByName(ctx, t.namespace, t.name, t.port)
 	}
-	return r.FindPodByName(ctx, namespace, h)
 }
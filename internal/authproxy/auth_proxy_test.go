@@ -2,20 +2,28 @@ package authproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cenkalti/backoff/v5"
+	"github.com/int128/kauthproxy/internal/certificate"
 	"github.com/int128/kauthproxy/internal/logger/mock_logger"
 	"github.com/int128/kauthproxy/internal/mocks/mock_browser"
-	"github.com/int128/kauthproxy/internal/mocks/mock_env"
+	"github.com/int128/kauthproxy/internal/mocks/mock_certificate"
 	"github.com/int128/kauthproxy/internal/mocks/mock_portforwarder"
 	"github.com/int128/kauthproxy/internal/mocks/mock_resolver"
 	"github.com/int128/kauthproxy/internal/mocks/mock_reverseproxy"
 	"github.com/int128/kauthproxy/internal/portforwarder"
+	"github.com/int128/kauthproxy/internal/resolver"
 	"github.com/int128/kauthproxy/internal/reverseproxy"
 	"github.com/int128/kauthproxy/internal/transport"
 	"go.uber.org/mock/gomock"
@@ -26,10 +34,37 @@ import (
 
 var notNil = gomock.Not(gomock.Nil())
 
-var restConfig rest.Config
+var launchURLMatcher = gomock.Cond(func(u string) bool {
+	return strings.HasPrefix(u, "http://localhost:8000/_kauthproxy/login?code=")
+})
+
+// withLoginCode returns a matcher of reverseproxy.Option with a random login code.
+func withLoginCode(want reverseproxy.Option) gomock.Matcher {
+	return gomock.Cond(func(got reverseproxy.Option) bool {
+		if got.LoginCode == "" {
+			return false
+		}
+		got.LoginCode = ""
+		return reflect.DeepEqual(got, want)
+	})
+}
+
+var restConfig = rest.Config{Host: "https://api.example.com:6443"}
 var authProxyTransport http.Transport
 
 func newTransport(t *testing.T) transport.NewFunc {
+	return func(got *rest.Config, o transport.Option) (http.RoundTripper, error) {
+		if got != &restConfig {
+			t.Errorf("rest.Config mismatch, got %+v", got)
+		}
+		if o.DialContext == nil {
+			t.Errorf("DialContext wants non-nil but was nil")
+		}
+		return &authProxyTransport, nil
+	}
+}
+
+func newAPIServerTransport(t *testing.T) transport.NewAPIServerFunc {
 	return func(got *rest.Config) (http.RoundTripper, error) {
 		if got != &restConfig {
 			t.Errorf("rest.Config mismatch, got %+v", got)
@@ -40,7 +75,6 @@ func newTransport(t *testing.T) transport.NewFunc {
 
 func TestAuthProxy_Do(t *testing.T) {
 	const containerPort = 18888
-	const transitPort = 28888
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "kubernetes-dashboard-12345678-12345678",
@@ -51,21 +85,16 @@ func TestAuthProxy_Do(t *testing.T) {
 	t.Run("ToPod", func(t *testing.T) {
 		type mocks struct {
 			resolverFactory *mock_resolver.MockFactoryInterface
-			env             *mock_env.MockInterface
 			browser         *mock_browser.MockInterface
 		}
 		newMocks := func(ctrl *gomock.Controller) mocks {
 			m := mocks{
 				resolverFactory: mock_resolver.NewMockFactoryInterface(ctrl),
-				env:             mock_env.NewMockInterface(ctrl),
 				browser:         mock_browser.NewMockInterface(ctrl),
 			}
-			m.env.EXPECT().
-				AllocateLocalPort().
-				Return(transitPort, nil)
 			mockResolver := mock_resolver.NewMockInterface(ctrl)
 			mockResolver.EXPECT().
-				FindPodByName(gomock.Any(), "NAMESPACE", "podname").
+				FindPodByName(gomock.Any(), "NAMESPACE", "podname", 0).
 				Return(pod, containerPort, nil)
 			m.resolverFactory.EXPECT().
 				New(&restConfig).
@@ -83,26 +112,25 @@ func TestAuthProxy_Do(t *testing.T) {
 			portForwarder.EXPECT().
 				Run(portforwarder.Option{
 					Config:              &restConfig,
-					SourcePort:          transitPort,
 					TargetNamespace:     "kubernetes-dashboard",
 					TargetPodName:       "kubernetes-dashboard-12345678-12345678",
 					TargetContainerPort: containerPort,
 				}, notNil, notNil).
-				DoAndReturn(func(o portforwarder.Option, readyChan chan struct{}, stopChan <-chan struct{}) error {
+				DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
 					time.Sleep(100 * time.Millisecond)
-					close(readyChan)
+					readyChan <- mock_portforwarder.NewMockConnection(ctrl)
 					<-stopChan
 					return nil
 				})
 			reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
 			reverseProxy.EXPECT().
-				Run(reverseproxy.Option{
+				Run(withLoginCode(reverseproxy.Option{
 					Transport:             &authProxyTransport,
 					BindAddressCandidates: []string{"127.0.0.1:8000"},
 					TargetScheme:          "https",
 					TargetHost:            "localhost",
-					TargetPort:            transitPort,
-				}, notNil).
+					TargetPort:            containerPort,
+				}), notNil).
 				DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
 					time.Sleep(100 * time.Millisecond)
 					i := mock_reverseproxy.NewMockInstance(ctrl)
@@ -116,13 +144,12 @@ func TestAuthProxy_Do(t *testing.T) {
 					return nil
 				})
 			m := newMocks(ctrl)
-			m.browser.EXPECT().Open("http://localhost:8000")
+			m.browser.EXPECT().Open(launchURLMatcher)
 			u := &AuthProxy{
 				ReverseProxy:    reverseProxy,
 				PortForwarder:   portForwarder,
 				ResolverFactory: m.resolverFactory,
 				NewTransport:    newTransport(t),
-				Env:             m.env,
 				Browser:         m.browser,
 				Logger:          mock_logger.New(t),
 			}
@@ -148,12 +175,11 @@ func TestAuthProxy_Do(t *testing.T) {
 			portForwarder.EXPECT().
 				Run(portforwarder.Option{
 					Config:              &restConfig,
-					SourcePort:          transitPort,
 					TargetNamespace:     "kubernetes-dashboard",
 					TargetPodName:       "kubernetes-dashboard-12345678-12345678",
 					TargetContainerPort: containerPort,
 				}, notNil, notNil).
-				DoAndReturn(func(o portforwarder.Option, readyChan chan struct{}, stopChan <-chan struct{}) error {
+				DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
 					return portForwarderError
 				})
 			reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
@@ -163,7 +189,6 @@ func TestAuthProxy_Do(t *testing.T) {
 				PortForwarder:   portForwarder,
 				ResolverFactory: m.resolverFactory,
 				NewTransport:    newTransport(t),
-				Env:             m.env,
 				Browser:         m.browser,
 				Logger:          mock_logger.New(t),
 			}
@@ -188,27 +213,26 @@ func TestAuthProxy_Do(t *testing.T) {
 			portForwarder.EXPECT().
 				Run(portforwarder.Option{
 					Config:              &restConfig,
-					SourcePort:          transitPort,
 					TargetNamespace:     "kubernetes-dashboard",
 					TargetPodName:       "kubernetes-dashboard-12345678-12345678",
 					TargetContainerPort: containerPort,
 				}, notNil, notNil).
-				DoAndReturn(func(o portforwarder.Option, readyChan chan struct{}, stopChan <-chan struct{}) error {
+				DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
 					time.Sleep(100 * time.Millisecond)
-					close(readyChan)
+					readyChan <- mock_portforwarder.NewMockConnection(ctrl)
 					<-stopChan
 					return nil
 				})
 			reverseProxyError := errors.New("could not listen")
 			reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
 			reverseProxy.EXPECT().
-				Run(reverseproxy.Option{
+				Run(withLoginCode(reverseproxy.Option{
 					Transport:             &authProxyTransport,
 					BindAddressCandidates: []string{"127.0.0.1:8000"},
 					TargetScheme:          "https",
 					TargetHost:            "localhost",
-					TargetPort:            transitPort,
-				}, notNil).
+					TargetPort:            containerPort,
+				}), notNil).
 				DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
 					return reverseProxyError
 				})
@@ -218,7 +242,6 @@ func TestAuthProxy_Do(t *testing.T) {
 				PortForwarder:   portForwarder,
 				ResolverFactory: m.resolverFactory,
 				NewTransport:    newTransport(t),
-				Env:             m.env,
 				Browser:         m.browser,
 				Logger:          mock_logger.New(t),
 			}
@@ -242,8 +265,8 @@ func TestAuthProxy_Do(t *testing.T) {
 			// backoff: 250-750ms (500ms ± 50% due to randomization)
 			// retry:   650-1150ms (worst case: 400ms + 750ms)
 			// 750-1250ms: the port forwarder is ready (2nd attempt)
-			// 850-1350ms: the reverse proxy is ready (2nd attempt)
 			// 1500ms: cancel the context
+			// the reverse proxy keeps running during the retry
 			ctx, cancel := context.WithTimeout(context.TODO(), 1500*time.Millisecond)
 			defer cancel()
 			ctrl := gomock.NewController(t)
@@ -254,15 +277,14 @@ func TestAuthProxy_Do(t *testing.T) {
 			portForwarder.EXPECT().
 				Run(portforwarder.Option{
 					Config:              &restConfig,
-					SourcePort:          transitPort,
 					TargetNamespace:     "kubernetes-dashboard",
 					TargetPodName:       "kubernetes-dashboard-12345678-12345678",
 					TargetContainerPort: containerPort,
 				}, notNil, notNil).
-				DoAndReturn(func(o portforwarder.Option, readyChan chan struct{}, stopChan <-chan struct{}) error {
+				DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
 					count := callCount.Add(1)
 					time.Sleep(100 * time.Millisecond)
-					close(readyChan)
+					readyChan <- mock_portforwarder.NewMockConnection(ctrl)
 					if count == 1 {
 						// First call: simulate connection lost after 300ms
 						time.Sleep(300 * time.Millisecond)
@@ -275,13 +297,13 @@ func TestAuthProxy_Do(t *testing.T) {
 				Times(2)
 			reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
 			reverseProxy.EXPECT().
-				Run(reverseproxy.Option{
+				Run(withLoginCode(reverseproxy.Option{
 					Transport:             &authProxyTransport,
 					BindAddressCandidates: []string{"127.0.0.1:8000"},
 					TargetScheme:          "https",
 					TargetHost:            "localhost",
-					TargetPort:            transitPort,
-				}, notNil).
+					TargetPort:            containerPort,
+				}), notNil).
 				DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
 					time.Sleep(100 * time.Millisecond)
 					i := mock_reverseproxy.NewMockInstance(ctrl)
@@ -293,16 +315,90 @@ func TestAuthProxy_Do(t *testing.T) {
 						Return(nil)
 					readyChan <- i
 					return nil
+				})
+			m := newMocks(ctrl)
+			m.browser.EXPECT().Open(launchURLMatcher)
+			u := &AuthProxy{
+				ReverseProxy:    reverseProxy,
+				PortForwarder:   portForwarder,
+				ResolverFactory: m.resolverFactory,
+				NewTransport:    newTransport(t),
+				Browser:         m.browser,
+				Logger:          mock_logger.New(t),
+			}
+			o := Option{
+				Config:                &restConfig,
+				Namespace:             "NAMESPACE",
+				TargetURL:             parseURL(t, "https://podname"),
+				BindAddressCandidates: []string{"127.0.0.1:8000"},
+			}
+			err := u.Do(ctx, o)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("err wants context.DeadlineExceeded but was %+v", err)
+			}
+		})
+		t.Run("PortForwarderConnectionLostAfterMaxElapsedTime", func(t *testing.T) {
+			// 0ms:   starting
+			// 100ms: the port forwarder is ready
+			// 400ms: lost connection after the time limit of retry
+			// 450ms: the port forwarder is ready (2nd attempt)
+			// 750ms: lost connection again
+			// 800ms: the port forwarder is ready (3rd attempt)
+			// 1200ms: cancel the context
+			ctx, cancel := context.WithTimeout(context.TODO(), 1200*time.Millisecond)
+			defer cancel()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			defaultBackOff, defaultMaxElapsedTime, defaultDelay := portForwarderBackOff, portForwarderRetryMaxElapsedTime, portForwarderReconnectDelay
+			t.Cleanup(func() {
+				portForwarderBackOff, portForwarderRetryMaxElapsedTime, portForwarderReconnectDelay = defaultBackOff, defaultMaxElapsedTime, defaultDelay
+			})
+			portForwarderBackOff = func() backoff.BackOff { return backoff.NewConstantBackOff(50 * time.Millisecond) }
+			portForwarderRetryMaxElapsedTime = 200 * time.Millisecond
+			portForwarderReconnectDelay = 50 * time.Millisecond
+
+			portForwarder := mock_portforwarder.NewMockInterface(ctrl)
+			var callCount atomic.Int32
+			portForwarder.EXPECT().
+				Run(portforwarder.Option{
+					Config:              &restConfig,
+					TargetNamespace:     "kubernetes-dashboard",
+					TargetPodName:       "kubernetes-dashboard-12345678-12345678",
+					TargetContainerPort: containerPort,
+				}, notNil, notNil).
+				DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
+					count := callCount.Add(1)
+					time.Sleep(100 * time.Millisecond)
+					readyChan <- mock_portforwarder.NewMockConnection(ctrl)
+					if count < 3 {
+						time.Sleep(300 * time.Millisecond)
+						return nil // lost connection
+					}
+					<-stopChan
+					return nil
 				}).
-				Times(2)
+				Times(3)
+			reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
+			reverseProxy.EXPECT().
+				Run(gomock.Any(), notNil).
+				DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
+					i := mock_reverseproxy.NewMockInstance(ctrl)
+					i.EXPECT().
+						URL().
+						Return(&url.URL{Scheme: "http", Host: "localhost:8000"})
+					i.EXPECT().
+						Shutdown(notNil).
+						Return(nil)
+					readyChan <- i
+					return nil
+				})
 			m := newMocks(ctrl)
-			m.browser.EXPECT().Open("http://localhost:8000")
+			m.browser.EXPECT().Open(launchURLMatcher)
 			u := &AuthProxy{
 				ReverseProxy:    reverseProxy,
 				PortForwarder:   portForwarder,
 				ResolverFactory: m.resolverFactory,
 				NewTransport:    newTransport(t),
-				Env:             m.env,
 				Browser:         m.browser,
 				Logger:          mock_logger.New(t),
 			}
@@ -322,21 +418,16 @@ func TestAuthProxy_Do(t *testing.T) {
 	t.Run("ToService", func(t *testing.T) {
 		type mocks struct {
 			resolverFactory *mock_resolver.MockFactoryInterface
-			env             *mock_env.MockInterface
 			browser         *mock_browser.MockInterface
 		}
 		newMocks := func(ctrl *gomock.Controller) mocks {
 			m := mocks{
 				resolverFactory: mock_resolver.NewMockFactoryInterface(ctrl),
-				env:             mock_env.NewMockInterface(ctrl),
 				browser:         mock_browser.NewMockInterface(ctrl),
 			}
-			m.env.EXPECT().
-				AllocateLocalPort().
-				Return(transitPort, nil)
 			mockResolver := mock_resolver.NewMockInterface(ctrl)
 			mockResolver.EXPECT().
-				FindPodByServiceName(gomock.Any(), "NAMESPACE", "servicename").
+				FindPodByServiceName(gomock.Any(), "NAMESPACE", "servicename", 0).
 				Return(pod, containerPort, nil)
 			m.resolverFactory.EXPECT().
 				New(&restConfig).
@@ -353,14 +444,13 @@ func TestAuthProxy_Do(t *testing.T) {
 			portForwarder.EXPECT().
 				Run(portforwarder.Option{
 					Config:              &restConfig,
-					SourcePort:          transitPort,
 					TargetNamespace:     "kubernetes-dashboard",
 					TargetPodName:       "kubernetes-dashboard-12345678-12345678",
 					TargetContainerPort: containerPort,
 				}, notNil, notNil).
-				DoAndReturn(func(o portforwarder.Option, readyChan chan struct{}, stopChan <-chan struct{}) error {
+				DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
 					time.Sleep(100 * time.Millisecond)
-					close(readyChan)
+					readyChan <- mock_portforwarder.NewMockConnection(ctrl)
 					<-stopChan
 					return nil
 				})
@@ -373,26 +463,25 @@ func TestAuthProxy_Do(t *testing.T) {
 				Return(nil)
 			reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
 			reverseProxy.EXPECT().
-				Run(reverseproxy.Option{
+				Run(withLoginCode(reverseproxy.Option{
 					Transport:             &authProxyTransport,
 					BindAddressCandidates: []string{"127.0.0.1:8000"},
 					TargetScheme:          "https",
 					TargetHost:            "localhost",
-					TargetPort:            transitPort,
-				}, notNil).
+					TargetPort:            containerPort,
+				}), notNil).
 				DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
 					time.Sleep(100 * time.Millisecond)
 					readyChan <- reverseProxyInstance
 					return nil
 				})
 			m := newMocks(ctrl)
-			m.browser.EXPECT().Open("http://localhost:8000")
+			m.browser.EXPECT().Open(launchURLMatcher)
 			u := &AuthProxy{
 				ReverseProxy:    reverseProxy,
 				PortForwarder:   portForwarder,
 				ResolverFactory: m.resolverFactory,
 				NewTransport:    newTransport(t),
-				Env:             m.env,
 				Browser:         m.browser,
 				Logger:          mock_logger.New(t),
 			}
@@ -407,6 +496,455 @@ func TestAuthProxy_Do(t *testing.T) {
 				t.Errorf("err wants context.DeadlineExceeded but was %+v", err)
 			}
 		})
+
+		t.Run("PortForwarderConnectionLost", func(t *testing.T) {
+			// 0ms:   starting
+			// 100ms: the port forwarder is ready
+			// 200ms: the reverse proxy is ready
+			// 400ms: lost connection
+			// 650-1150ms: resolve the service again and switch to the replacement pod
+			// 750-1250ms: the port forwarder is ready (2nd attempt)
+			// 1500ms: cancel the context
+			ctx, cancel := context.WithTimeout(context.TODO(), 1500*time.Millisecond)
+			defer cancel()
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			replacementPod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "kubernetes-dashboard-12345678-87654321",
+					Namespace: "kubernetes-dashboard",
+				},
+			}
+			portForwarder := mock_portforwarder.NewMockInterface(ctrl)
+			gomock.InOrder(
+				portForwarder.EXPECT().
+					Run(portforwarder.Option{
+						Config:              &restConfig,
+						TargetNamespace:     "kubernetes-dashboard",
+						TargetPodName:       "kubernetes-dashboard-12345678-12345678",
+						TargetContainerPort: containerPort,
+					}, notNil, notNil).
+					DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
+						time.Sleep(100 * time.Millisecond)
+						readyChan <- mock_portforwarder.NewMockConnection(ctrl)
+						time.Sleep(300 * time.Millisecond)
+						return nil // lost connection
+					}),
+				portForwarder.EXPECT().
+					Run(portforwarder.Option{
+						Config:              &restConfig,
+						TargetNamespace:     "kubernetes-dashboard",
+						TargetPodName:       "kubernetes-dashboard-12345678-87654321",
+						TargetContainerPort: containerPort,
+					}, notNil, notNil).
+					DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
+						time.Sleep(100 * time.Millisecond)
+						readyChan <- mock_portforwarder.NewMockConnection(ctrl)
+						<-stopChan
+						return nil
+					}),
+			)
+			reverseProxyInstance := mock_reverseproxy.NewMockInstance(ctrl)
+			reverseProxyInstance.EXPECT().
+				URL().
+				Return(&url.URL{Scheme: "http", Host: "localhost:8000"})
+			reverseProxyInstance.EXPECT().
+				Shutdown(notNil).
+				Return(nil)
+			reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
+			reverseProxy.EXPECT().
+				Run(withLoginCode(reverseproxy.Option{
+					Transport:             &authProxyTransport,
+					BindAddressCandidates: []string{"127.0.0.1:8000"},
+					TargetScheme:          "https",
+					TargetHost:            "localhost",
+					TargetPort:            containerPort,
+				}), notNil).
+				DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
+					time.Sleep(100 * time.Millisecond)
+					readyChan <- reverseProxyInstance
+					return nil
+				})
+			resolverFactory := mock_resolver.NewMockFactoryInterface(ctrl)
+			mockResolver := mock_resolver.NewMockInterface(ctrl)
+			gomock.InOrder(
+				mockResolver.EXPECT().
+					FindPodByServiceName(gomock.Any(), "NAMESPACE", "servicename", 0).
+					Return(pod, containerPort, nil),
+				mockResolver.EXPECT().
+					FindPodByServiceName(gomock.Any(), "NAMESPACE", "servicename", 0).
+					Return(replacementPod, containerPort, nil),
+			)
+			resolverFactory.EXPECT().
+				New(&restConfig).
+				Return(mockResolver, nil)
+			browser := mock_browser.NewMockInterface(ctrl)
+			browser.EXPECT().Open(launchURLMatcher)
+			u := &AuthProxy{
+				ReverseProxy:    reverseProxy,
+				PortForwarder:   portForwarder,
+				ResolverFactory: resolverFactory,
+				NewTransport:    newTransport(t),
+				Browser:         browser,
+				Logger:          mock_logger.New(t),
+			}
+			o := Option{
+				Config:                &restConfig,
+				Namespace:             "NAMESPACE",
+				TargetURL:             parseURL(t, "https://servicename.svc"),
+				BindAddressCandidates: []string{"127.0.0.1:8000"},
+			}
+			err := u.Do(ctx, o)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("err wants context.DeadlineExceeded but was %+v", err)
+			}
+		})
+	})
+}
+
+func TestAuthProxy_Do_ServiceProxy(t *testing.T) {
+	run := func(t *testing.T, ctrl *gomock.Controller, resolverFactory resolver.FactoryInterface, targetURL, wantPathPrefix string) {
+		ctx, cancel := context.WithTimeout(context.TODO(), 500*time.Millisecond)
+		defer cancel()
+		reverseProxyInstance := mock_reverseproxy.NewMockInstance(ctrl)
+		reverseProxyInstance.EXPECT().
+			URL().
+			Return(&url.URL{Scheme: "http", Host: "localhost:8000"})
+		reverseProxyInstance.EXPECT().
+			Shutdown(notNil).
+			Return(nil)
+		reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
+		reverseProxy.EXPECT().
+			Run(withLoginCode(reverseproxy.Option{
+				Transport:             &authProxyTransport,
+				BindAddressCandidates: []string{"127.0.0.1:8000"},
+				TargetScheme:          "https",
+				TargetHost:            "api.example.com",
+				TargetPort:            6443,
+				TargetPathPrefix:      wantPathPrefix,
+			}), notNil).
+			DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
+				time.Sleep(100 * time.Millisecond)
+				readyChan <- reverseProxyInstance
+				return nil
+			})
+		browser := mock_browser.NewMockInterface(ctrl)
+		browser.EXPECT().Open(launchURLMatcher)
+		u := &AuthProxy{
+			ReverseProxy:          reverseProxy,
+			PortForwarder:         mock_portforwarder.NewMockInterface(ctrl),
+			ResolverFactory:       resolverFactory,
+			NewAPIServerTransport: newAPIServerTransport(t),
+			Browser:               browser,
+			Logger:                mock_logger.New(t),
+		}
+		o := Option{
+			Config:                &restConfig,
+			Namespace:             "NAMESPACE",
+			TargetURL:             parseURL(t, targetURL),
+			BindAddressCandidates: []string{"127.0.0.1:8000"},
+			Mode:                  ModeServiceProxy,
+		}
+		err := u.Do(ctx, o)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err wants context.DeadlineExceeded but was %+v", err)
+		}
+	}
+
+	t.Run("Service", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		run(t, ctrl, mock_resolver.NewMockFactoryInterface(ctrl),
+			"https://headlamp.kube-system.svc:8443",
+			"/api/v1/namespaces/kube-system/services/https:headlamp:8443/proxy")
+	})
+	t.Run("PodWithoutPort", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mockResolver := mock_resolver.NewMockInterface(ctrl)
+		mockResolver.EXPECT().
+			FindPodByName(gomock.Any(), "NAMESPACE", "podname", 0).
+			Return(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "podname", Namespace: "NAMESPACE"}}, 4466, nil)
+		resolverFactory := mock_resolver.NewMockFactoryInterface(ctrl)
+		resolverFactory.EXPECT().
+			New(&restConfig).
+			Return(mockResolver, nil)
+		run(t, ctrl, resolverFactory,
+			"https://podname",
+			"/api/v1/namespaces/NAMESPACE/pods/https:podname:4466/proxy")
+	})
+}
+
+// logRecorder records the messages of mock_logger.
+type logRecorder struct {
+	*testing.T
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *logRecorder) Logf(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, fmt.Sprintf(format, args...))
+	r.T.Logf(format, args...)
+}
+
+func (r *logRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.messages, "\n")
+}
+
+func TestAuthProxy_DoAll(t *testing.T) {
+	newReverseProxyInstance := func(ctrl *gomock.Controller, port int) reverseproxy.Instance {
+		i := mock_reverseproxy.NewMockInstance(ctrl)
+		i.EXPECT().
+			URL().
+			Return(&url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", port)})
+		i.EXPECT().
+			Shutdown(notNil).
+			Return(nil)
+		return i
+	}
+	options := []Option{
+		{
+			Config:                &restConfig,
+			Namespace:             "NAMESPACE",
+			TargetURL:             parseURL(t, "https://headlamp.kube-system.svc:8443"),
+			BindAddressCandidates: []string{"127.0.0.1:8000"},
+			SkipOpenBrowser:       true,
+			Mode:                  ModeServiceProxy,
+		},
+		{
+			Config:                &restConfig,
+			Namespace:             "NAMESPACE",
+			TargetURL:             parseURL(t, "http://grafana.monitoring.svc"),
+			BindAddressCandidates: []string{"127.0.0.1:8001"},
+			SkipOpenBrowser:       true,
+			Mode:                  ModeServiceProxy,
+		},
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.TODO(), 500*time.Millisecond)
+		defer cancel()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
+		reverseProxy.EXPECT().
+			Run(gomock.Any(), notNil).
+			DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
+				switch o.BindAddressCandidates[0] {
+				case "127.0.0.1:8000":
+					readyChan <- newReverseProxyInstance(ctrl, 8000)
+				case "127.0.0.1:8001":
+					readyChan <- newReverseProxyInstance(ctrl, 8001)
+				default:
+					t.Errorf("unexpected BindAddressCandidates %v", o.BindAddressCandidates)
+				}
+				return nil
+			}).
+			Times(2)
+		recorder := &logRecorder{T: t}
+		u := &AuthProxy{
+			ReverseProxy:          reverseProxy,
+			PortForwarder:         mock_portforwarder.NewMockInterface(ctrl),
+			ResolverFactory:       mock_resolver.NewMockFactoryInterface(ctrl),
+			NewAPIServerTransport: newAPIServerTransport(t),
+			Browser:               mock_browser.NewMockInterface(ctrl),
+			Logger:                mock_logger.New(recorder),
+		}
+		err := u.DoAll(ctx, options)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err wants context.DeadlineExceeded but was %+v", err)
+		}
+		output := recorder.String()
+		for _, want := range []string{
+			"https://headlamp.kube-system.svc:8443  http://localhost:8000/_kauthproxy/login?code=",
+			"http://grafana.monitoring.svc          http://localhost:8001/_kauthproxy/login?code=",
+		} {
+			if !strings.Contains(output, want) {
+				t.Errorf("output wants %q but was %s", want, output)
+			}
+		}
+	})
+
+	t.Run("SharedCertificateAndBrowser", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.TODO(), 500*time.Millisecond)
+		defer cancel()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		tlsOption := &certificate.Option{CacheDir: "CACHE_DIR"}
+		cert := &tls.Certificate{}
+		c := mock_certificate.NewMockInterface(ctrl)
+		c.EXPECT().
+			Load(*tlsOption).
+			Return(cert, nil)
+		reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
+		reverseProxy.EXPECT().
+			Run(gomock.Any(), notNil).
+			DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
+				if o.TLSCertificate != cert {
+					t.Errorf("TLSCertificate wants the shared certificate but was %v", o.TLSCertificate)
+				}
+				switch o.BindAddressCandidates[0] {
+				case "127.0.0.1:8000":
+					readyChan <- newReverseProxyInstance(ctrl, 8000)
+				case "127.0.0.1:8001":
+					readyChan <- newReverseProxyInstance(ctrl, 8001)
+				}
+				return nil
+			}).
+			Times(2)
+		browser := mock_browser.NewMockInterface(ctrl)
+		browser.EXPECT().
+			Open(launchURLMatcher)
+		u := &AuthProxy{
+			ReverseProxy:          reverseProxy,
+			PortForwarder:         mock_portforwarder.NewMockInterface(ctrl),
+			ResolverFactory:       mock_resolver.NewMockFactoryInterface(ctrl),
+			NewAPIServerTransport: newAPIServerTransport(t),
+			Browser:               browser,
+			Certificate:           c,
+			Logger:                mock_logger.New(t),
+		}
+		var tlsOptions []Option
+		for _, o := range options {
+			o.TLS = tlsOption
+			o.SkipOpenBrowser = false
+			tlsOptions = append(tlsOptions, o)
+		}
+		err := u.DoAll(ctx, tlsOptions)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err wants context.DeadlineExceeded but was %+v", err)
+		}
+	})
+
+	t.Run("ReverseProxyError", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.TODO(), 500*time.Millisecond)
+		defer cancel()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		reverseProxyError := errors.New("could not listen")
+		reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
+		reverseProxy.EXPECT().
+			Run(gomock.Any(), notNil).
+			DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
+				if o.BindAddressCandidates[0] == "127.0.0.1:8001" {
+					time.Sleep(100 * time.Millisecond)
+					return reverseProxyError
+				}
+				readyChan <- newReverseProxyInstance(ctrl, 8000)
+				return nil
+			}).
+			Times(2)
+		u := &AuthProxy{
+			ReverseProxy:          reverseProxy,
+			PortForwarder:         mock_portforwarder.NewMockInterface(ctrl),
+			ResolverFactory:       mock_resolver.NewMockFactoryInterface(ctrl),
+			NewAPIServerTransport: newAPIServerTransport(t),
+			Browser:               mock_browser.NewMockInterface(ctrl),
+			Logger:                mock_logger.New(t),
+		}
+		err := u.DoAll(ctx, options)
+		if !errors.Is(err, reverseProxyError) {
+			t.Errorf("err wants the reverseProxyError but was %+v", err)
+		}
+	})
+}
+
+func TestAuthProxy_runPortForwarder(t *testing.T) {
+	t.Run("ReadyAndLostAtOnce", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		portForwarder := mock_portforwarder.NewMockInterface(ctrl)
+		portForwarder.EXPECT().
+			Run(gomock.Any(), notNil, notNil).
+			DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
+				readyChan <- mock_portforwarder.NewMockConnection(ctrl)
+				return nil // lost connection
+			}).
+			AnyTimes()
+		u := &AuthProxy{PortForwarder: portForwarder, Logger: mock_logger.New(t)}
+		// the watcher may receive either the connection or the end of port forwarder first
+		for range 100 {
+			readyChan := make(chan struct{})
+			err := u.runPortForwarder(context.TODO(), portforwarder.Option{}, &dialer{}, readyChan)
+			if !errors.Is(err, errPortForwarderConnectionLost) {
+				t.Fatalf("err wants errPortForwarderConnectionLost but was %+v", err)
+			}
+			select {
+			case <-readyChan:
+			default:
+				t.Fatalf("readyChan wants closed but was open")
+			}
+		}
+	})
+}
+
+func TestLaunchURL(t *testing.T) {
+	base := &url.URL{Scheme: "http", Host: "127.0.0.1:18000"}
+	if got, want := launchURL(base, "CODE", ""), "http://127.0.0.1:18000/_kauthproxy/login?code=CODE"; got != want {
+		t.Errorf("launchURL wants %s but was %s", want, got)
+	}
+	if got, want := launchURL(base, "CODE", "/c/main/pods"), "http://127.0.0.1:18000/_kauthproxy/login?code=CODE&path=%2Fc%2Fmain%2Fpods"; got != want {
+		t.Errorf("launchURL wants %s but was %s", want, got)
+	}
+}
+
+func TestParseTargetURL(t *testing.T) {
+	tests := map[string]target{
+		"http://podname":                                     {kind: targetKindPod, namespace: "NAMESPACE", name: "podname"},
+		"http://pod.podname:8080":                            {kind: targetKindPod, namespace: "NAMESPACE", name: "podname", port: 8080},
+		"http://servicename.svc":                             {kind: targetKindService, namespace: "NAMESPACE", name: "servicename"},
+		"http://servicename.svc:8080":                        {kind: targetKindService, namespace: "NAMESPACE", name: "servicename", port: 8080},
+		"http://deploy.headlamp":                             {kind: targetKindWorkload, workloadKind: resolver.WorkloadKindDeployment, namespace: "NAMESPACE", name: "headlamp"},
+		"http://statefulset.headlamp":                        {kind: targetKindWorkload, workloadKind: resolver.WorkloadKindStatefulSet, namespace: "NAMESPACE", name: "headlamp"},
+		"http://ds.headlamp:4466":                            {kind: targetKindWorkload, workloadKind: resolver.WorkloadKindDaemonSet, namespace: "NAMESPACE", name: "headlamp", port: 4466},
+		"http://headlamp.kube-system.svc":                    {kind: targetKindService, namespace: "kube-system", name: "headlamp"},
+		"http://headlamp.kube-system.svc:8080":               {kind: targetKindService, namespace: "kube-system", name: "headlamp", port: 8080},
+		"http://headlamp.kube-system.svc.cluster.local":      {kind: targetKindService, namespace: "kube-system", name: "headlamp"},
+		"http://headlamp.kube-system.svc.cluster.local.:443": {kind: targetKindService, namespace: "kube-system", name: "headlamp", port: 443},
+		"http://headlamp.svc.cluster.local":                  {kind: targetKindService, namespace: "NAMESPACE", name: "headlamp"},
+	}
+	for input, want := range tests {
+		t.Run(input, func(t *testing.T) {
+			got, err := parseTargetURL("NAMESPACE", false, parseURL(t, input))
+			if err != nil {
+				t.Fatalf("parseTargetURL error: %s", err)
+			}
+			if got != want {
+				t.Errorf("target wants %+v but was %+v", want, got)
+			}
+		})
+	}
+
+	t.Run("NamespaceOverridden", func(t *testing.T) {
+		got, err := parseTargetURL("kube-system", true, parseURL(t, "http://headlamp.kube-system.svc"))
+		if err != nil {
+			t.Fatalf("parseTargetURL error: %s", err)
+		}
+		want := target{kind: targetKindService, namespace: "kube-system", name: "headlamp"}
+		if got != want {
+			t.Errorf("target wants %+v but was %+v", want, got)
+		}
+	})
+	t.Run("NamespaceConflict", func(t *testing.T) {
+		_, err := parseTargetURL("default", true, parseURL(t, "http://headlamp.kube-system.svc"))
+		const want = "namespace kube-system in the URL conflicts with the namespace default given by the flag"
+		if err == nil || err.Error() != want {
+			t.Errorf("err wants %q but was %v", want, err)
+		}
+	})
+	t.Run("TooManyLabels", func(t *testing.T) {
+		_, err := parseTargetURL("default", false, parseURL(t, "http://a.b.c.svc"))
+		if err == nil {
+			t.Errorf("err wants non-nil but was nil")
+		}
 	})
 }
 
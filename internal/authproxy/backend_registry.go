@@ -0,0 +1,138 @@
+package authproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/int128/kauthproxy/internal/resolver"
+	"github.com/int128/kauthproxy/internal/reverseproxy"
+)
+
+// backendRegistry is the registry of the port forwarders started on demand.
+// A port forwarder is started on the first request to the key, e.g. the name of a virtual host,
+// and removed from the registry when it is stopped, so that the next request starts it again.
+type backendRegistry struct {
+	u   *AuthProxy
+	ctx context.Context
+	o   Option
+	rsv resolver.Interface
+	// targetURL returns the target URL of the key
+	targetURL func(key string) *url.URL
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	entries map[string]*backendEntry
+}
+
+type backendEntry struct {
+	// ready is closed when route or err is set
+	ready  chan struct{}
+	route  reverseproxy.Route
+	dialer *dialer
+	err    error
+}
+
+// newBackendRegistry returns a registry.
+// The port forwarders are stopped when the context is canceled.
+// Caller should wait for them by wg.
+func newBackendRegistry(ctx context.Context, u *AuthProxy, o Option, rsv resolver.Interface, targetURL func(key string) *url.URL) *backendRegistry {
+	return &backendRegistry{
+		u:         u,
+		ctx:       ctx,
+		o:         o,
+		rsv:       rsv,
+		targetURL: targetURL,
+		entries:   map[string]*backendEntry{},
+	}
+}
+
+// route returns the route to the backend of the key.
+// It waits for the port forwarder if it is starting.
+func (r *backendRegistry) route(ctx context.Context, key string) (reverseproxy.Route, error) {
+	e, err := r.get(ctx, key)
+	if err != nil {
+		return reverseproxy.Route{}, err
+	}
+	return e.route, nil
+}
+
+// dial returns a connection to the backend of the key.
+func (r *backendRegistry) dial(ctx context.Context, key string) (net.Conn, error) {
+	e, err := r.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return e.dialer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", e.route.TargetPort))
+}
+
+func (r *backendRegistry) get(ctx context.Context, key string) (*backendEntry, error) {
+	r.mu.Lock()
+	e, ok := r.entries[key]
+	if !ok {
+		e = &backendEntry{ready: make(chan struct{})}
+		r.entries[key] = e
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer r.remove(key, e)
+			r.start(key, e)
+		}()
+	}
+	r.mu.Unlock()
+	select {
+	case <-e.ready:
+		return e, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// start runs a port forwarder to the target of the key, and waits for it.
+func (r *backendRegistry) start(key string, e *backendEntry) {
+	// remove the entry before the waiters receive the error, so that the next request retries
+	fail := func(err error) {
+		r.remove(key, e)
+		e.err = err
+		close(e.ready)
+	}
+	targetURL := r.targetURL(key)
+	t, err := parseTargetURL(r.o.Namespace, r.o.NamespaceOverridden, targetURL)
+	if err != nil {
+		fail(fmt.Errorf("invalid target: %w", err))
+		return
+	}
+	b, rpTransport, containerPort, err := r.u.newBackend(r.ctx, r.o, t, r.rsv)
+	if err != nil {
+		fail(err)
+		return
+	}
+	r.u.Logger.Printf("Starting a port forwarder to service %s/%s for %s", t.namespace, t.name, key)
+	readyChan := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- r.u.runPortForwarderWithRetry(r.ctx, b, readyChan)
+	}()
+	select {
+	case <-readyChan:
+		e.route = Route{TargetURL: targetURL}.reverseProxyRoute(rpTransport, containerPort)
+		e.dialer = b.dialer
+		close(e.ready)
+	case err := <-done:
+		fail(fmt.Errorf("could not run a port forwarder: %w", err))
+		return
+	}
+	if err := <-done; r.ctx.Err() == nil {
+		r.u.Logger.Printf("Stopped the port forwarder to service %s/%s: %s", t.namespace, t.name, err)
+	}
+}
+
+func (r *backendRegistry) remove(key string, e *backendEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries[key] == e {
+		delete(r.entries, key)
+	}
+}
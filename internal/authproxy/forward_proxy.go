@@ -0,0 +1,59 @@
+package authproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/int128/kauthproxy/internal/resolver"
+	"github.com/int128/kauthproxy/internal/reverseproxy"
+)
+
+// forwardProxyDomains is the domain suffixes of the services accepted by the forward proxy.
+var forwardProxyDomains = []string{"svc", "svc.cluster.local"}
+
+// doForwardProxy runs a forward proxy which accepts a request to a service,
+// i.e. NAME.NAMESPACE.svc[:PORT].
+// The port forwarder to a service is started on the first request.
+func (u *AuthProxy) doForwardProxy(ctx context.Context, o Option, rsv resolver.Interface) error {
+	ctx, cancel := context.WithCancel(ctx)
+	registry := newBackendRegistry(ctx, u, o, rsv, func(hostport string) *url.URL {
+		return &url.URL{Scheme: "http", Host: hostport}
+	})
+	// stop the port forwarders and wait for them when the forward proxy is stopped
+	defer registry.wg.Wait()
+	defer cancel()
+	u.Logger.V(1).Infof("client -> forward_proxy -> NAME.NAMESPACE.svc -> port_forwarder -> pod")
+	ro := runOption{
+		reverseProxyOption: reverseproxy.Option{
+			BindAddressCandidates: o.BindAddressCandidates,
+			ReadOnly:              o.ReadOnly,
+			Policy:                o.Policy,
+			StripHeaders:          o.StripHeaders,
+			ForwardProxy: &reverseproxy.ForwardProxyOption{
+				Domains: forwardProxyDomains,
+				Route: func(ctx context.Context, host, port string) (reverseproxy.Route, error) {
+					return registry.route(ctx, registryKey(host, port))
+				},
+				Dial: func(ctx context.Context, host, port string) (net.Conn, error) {
+					return registry.dial(ctx, registryKey(host, port))
+				},
+			},
+		},
+		forwardProxy: true,
+	}
+	if err := u.run(ctx, ro); err != nil {
+		return fmt.Errorf("error while running a forward proxy: %w", err)
+	}
+	return nil
+}
+
+// registryKey returns the key of the host and port.
+// If the port is empty, it returns the host, which means any port of the service.
+func registryKey(host, port string) string {
+	if port == "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,114 @@
+package authproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/int128/kauthproxy/internal/logger/mock_logger"
+	"github.com/int128/kauthproxy/internal/mocks/mock_browser"
+	"github.com/int128/kauthproxy/internal/mocks/mock_portforwarder"
+	"github.com/int128/kauthproxy/internal/mocks/mock_resolver"
+	"github.com/int128/kauthproxy/internal/mocks/mock_reverseproxy"
+	"github.com/int128/kauthproxy/internal/portforwarder"
+	"github.com/int128/kauthproxy/internal/reverseproxy"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAuthProxy_Do_ForwardProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 500*time.Millisecond)
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	grafanaPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "grafana-12345678", Namespace: "monitoring"}}
+	mockResolver := mock_resolver.NewMockInterface(ctrl)
+	mockResolver.EXPECT().
+		FindPodByServiceName(gomock.Any(), "monitoring", "grafana", 0).
+		Return(grafanaPod, 3000, nil)
+	mockResolver.EXPECT().
+		FindPodByServiceName(gomock.Any(), "monitoring", "grafana", 443).
+		Return(grafanaPod, 3443, nil)
+	resolverFactory := mock_resolver.NewMockFactoryInterface(ctrl)
+	resolverFactory.EXPECT().
+		New(&restConfig).
+		Return(mockResolver, nil)
+	tunnelConn, _ := net.Pipe()
+	portForwarder := mock_portforwarder.NewMockInterface(ctrl)
+	portForwarder.EXPECT().
+		Run(gomock.Cond(func(o portforwarder.Option) bool {
+			return o.TargetContainerPort == 3000
+		}), notNil, notNil).
+		DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
+			readyChan <- mock_portforwarder.NewMockConnection(ctrl)
+			<-stopChan
+			return nil
+		})
+	portForwarder.EXPECT().
+		Run(gomock.Cond(func(o portforwarder.Option) bool {
+			return o.TargetContainerPort == 3443
+		}), notNil, notNil).
+		DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
+			conn := mock_portforwarder.NewMockConnection(ctrl)
+			conn.EXPECT().
+				DialContext(gomock.Any(), "tcp", "localhost:3443").
+				Return(tunnelConn, nil)
+			readyChan <- conn
+			<-stopChan
+			return nil
+		})
+
+	reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
+	reverseProxy.EXPECT().
+		Run(gomock.Any(), notNil).
+		DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
+			if o.ForwardProxy == nil {
+				t.Errorf("ForwardProxy wants non-nil but was nil")
+				return nil
+			}
+			route, err := o.ForwardProxy.Route(context.TODO(), "grafana.monitoring.svc", "")
+			if err != nil {
+				t.Errorf("Route error: %s", err)
+			} else if route.TargetPort != 3000 || route.TargetScheme != "http" {
+				t.Errorf("route mismatch: %+v", route)
+			}
+			conn, err := o.ForwardProxy.Dial(context.TODO(), "grafana.monitoring.svc", "443")
+			if err != nil {
+				t.Errorf("Dial error: %s", err)
+			} else if conn != tunnelConn {
+				t.Errorf("Dial wants the connection of the port forwarder but was %v", conn)
+			}
+			i := mock_reverseproxy.NewMockInstance(ctrl)
+			i.EXPECT().
+				URL().
+				Return(&url.URL{Scheme: "http", Host: "localhost:8000"})
+			i.EXPECT().
+				Shutdown(notNil).
+				Return(nil)
+			readyChan <- i
+			return nil
+		})
+	u := &AuthProxy{
+		ReverseProxy:    reverseProxy,
+		PortForwarder:   portForwarder,
+		ResolverFactory: resolverFactory,
+		NewTransport:    newTransport(t),
+		Browser:         mock_browser.NewMockInterface(ctrl),
+		Logger:          mock_logger.New(t),
+	}
+	o := Option{
+		Config:                &restConfig,
+		Namespace:             "NAMESPACE",
+		BindAddressCandidates: []string{"127.0.0.1:8000"},
+		ForwardProxy:          true,
+	}
+	err := u.Do(ctx, o)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err wants context.DeadlineExceeded but was %+v", err)
+	}
+}
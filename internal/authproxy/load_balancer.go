@@ -0,0 +1,253 @@
+package authproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/int128/kauthproxy/internal/portforwarder"
+	"github.com/int128/kauthproxy/internal/resolver"
+	"github.com/int128/kauthproxy/internal/reverseproxy"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// loadBalancerCookieName is the name of cookie to keep a browser on the same backend.
+// The name is suffixed with the port of the reverse proxy, see reverseproxy.CookieName.
+const loadBalancerCookieName = "kauthproxy_backend"
+
+const loadBalancerHostPrefix = "backend-"
+
+// doLoadBalance runs port forwarders to the ready pods behind the service,
+// and a reverse proxy which distributes requests across them.
+func (u *AuthProxy) doLoadBalance(ctx context.Context, o Option, t target, rsv resolver.Interface) error {
+	if t.kind != targetKindService {
+		return fmt.Errorf("load balancing supports only a service")
+	}
+	endpoints, err := rsv.FindEndpointsByServiceName(ctx, t.namespace, t.name, t.port)
+	if err != nil {
+		return fmt.Errorf("could not find the pods and container ports: %w", err)
+	}
+	size := min(o.LoadBalance, len(endpoints))
+	if size < o.LoadBalance {
+		u.Logger.Printf("Found only %d ready pod(s) of service %s", len(endpoints), t.name)
+	}
+	to, err := u.newTransportOption(ctx, o, t, rsv)
+	if err != nil {
+		return fmt.Errorf("invalid upstream TLS option: %w", err)
+	}
+	lb := newLoadBalancer(size)
+	to.DialContext = lb.DialContext
+	lb.transport, err = u.NewTransport(o.Config, to)
+	if err != nil {
+		return fmt.Errorf("could not create a transport for reverse proxy: %w", err)
+	}
+	backends := make([]backend, size)
+	for i := range size {
+		endpoint := endpoints[i]
+		lb.setPodName(i, endpoint.Pod.Name)
+		u.Logger.V(1).Infof("client -> reverse_proxy -> port_forwarder[%d] -> pod %s -> container:%d",
+			i, endpoint.Pod.Name, endpoint.ContainerPort)
+		backends[i] = backend{
+			dialer: lb.dialers[i],
+			portForwarderOption: portforwarder.Option{
+				Config:              o.Config,
+				TargetNamespace:     endpoint.Pod.Namespace,
+				TargetPodName:       endpoint.Pod.Name,
+				TargetContainerPort: endpoint.ContainerPort,
+				Protocol:            o.PortForwardProtocol,
+			},
+			resolve: func(ctx context.Context) (*corev1.Pod, int, error) {
+				endpoints, err := rsv.FindEndpointsByServiceName(ctx, t.namespace, t.name, t.port)
+				if err != nil {
+					return nil, 0, err
+				}
+				endpoint := lb.choose(i, endpoints)
+				return endpoint.Pod, endpoint.ContainerPort, nil
+			},
+		}
+	}
+	ro := runOption{
+		backends: backends,
+		reverseProxyOption: reverseproxy.Option{
+			Transport:             lb,
+			BindAddressCandidates: o.BindAddressCandidates,
+			TargetScheme:          o.TargetURL.Scheme,
+			TargetHost:            "localhost",
+			TargetPort:            endpoints[0].ContainerPort,
+			ReadOnly:              o.ReadOnly,
+			Policy:                o.Policy,
+			StripHeaders:          o.StripHeaders,
+		},
+		skipOpenBrowser: o.SkipOpenBrowser,
+		tls:             o.TLS,
+		tlsCertificate:  o.tlsCertificate,
+		onReady:         o.onReady,
+		openPath:        o.OpenPath,
+	}
+	if err := u.run(ctx, ro); err != nil {
+		return fmt.Errorf("error while running an authentication proxy: %w", err)
+	}
+	return nil
+}
+
+// loadBalancer distributes requests across the port forwarders in round-robin.
+// A browser is kept on the same backend by the cookie, so that a stateful UI keeps working.
+// A backend is skipped while the port forwarder is reconnecting.
+//
+// It routes a request to the backend by rewriting the host of the URL,
+// and the transport dials to the backend corresponding to the host.
+type loadBalancer struct {
+	transport http.RoundTripper
+	dialers   []*dialer
+
+	mu       sync.Mutex
+	podNames []string
+	next     int
+}
+
+func newLoadBalancer(size int) *loadBalancer {
+	lb := &loadBalancer{
+		dialers:  make([]*dialer, size),
+		podNames: make([]string, size),
+	}
+	for i := range lb.dialers {
+		lb.dialers[i] = &dialer{}
+	}
+	return lb
+}
+
+func (lb *loadBalancer) setPodName(i int, podName string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.podNames[i] = podName
+}
+
+// choose returns the endpoint for the backend.
+// It prefers a pod which is not used by the other backends.
+func (lb *loadBalancer) choose(i int, endpoints []resolver.Endpoint) resolver.Endpoint {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	chosen := endpoints[0]
+	for _, endpoint := range endpoints {
+		inUse := false
+		for j, podName := range lb.podNames {
+			if j != i && podName == endpoint.Pod.Name {
+				inUse = true
+			}
+		}
+		if !inUse {
+			chosen = endpoint
+			break
+		}
+	}
+	lb.podNames[i] = chosen.Pod.Name
+	return chosen
+}
+
+// DialContext dials to the backend corresponding to the host of the address.
+func (lb *loadBalancer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %w", address, err)
+	}
+	i, ok := parseBackendHost(host, len(lb.dialers))
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %s", host)
+	}
+	return lb.dialers[i].DialContext(ctx, network, address)
+}
+
+func (lb *loadBalancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	i, sticky := lb.stickyBackend(req)
+	if !sticky {
+		var ok bool
+		if i, ok = lb.nextBackend(); !ok {
+			return nil, errPortForwarderNotReady
+		}
+	}
+	cookieName := loadBalancerCookie(req)
+	req = req.Clone(req.Context())
+	reverseproxy.RemoveCookie(req, cookieName)
+	// keep the host header as-is
+	req.Host = req.URL.Host
+	_, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host %s: %w", req.URL.Host, err)
+	}
+	req.URL.Host = net.JoinHostPort(fmt.Sprintf("%s%d", loadBalancerHostPrefix, i), port)
+	resp, err := lb.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if !sticky {
+		c := &http.Cookie{
+			Name:     cookieName,
+			Value:    strconv.Itoa(i),
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		resp.Header.Add("Set-Cookie", c.String())
+	}
+	return resp, nil
+}
+
+// stickyBackend returns the backend in the cookie if it is ready.
+func (lb *loadBalancer) stickyBackend(req *http.Request) (int, bool) {
+	c, err := req.Cookie(loadBalancerCookie(req))
+	if err != nil {
+		return 0, false
+	}
+	i, err := strconv.Atoi(c.Value)
+	if err != nil || i < 0 || i >= len(lb.dialers) {
+		return 0, false
+	}
+	if !lb.dialers[i].ready() {
+		return 0, false
+	}
+	return i, true
+}
+
+// loadBalancerCookie returns the name of cookie for the port of the reverse proxy,
+// which is the local address of the connection from the browser.
+func loadBalancerCookie(req *http.Request) string {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return loadBalancerCookieName
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return loadBalancerCookieName
+	}
+	return reverseproxy.CookieName(loadBalancerCookieName, port)
+}
+
+// nextBackend returns a ready backend in round-robin.
+func (lb *loadBalancer) nextBackend() (int, bool) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for range lb.dialers {
+		i := lb.next
+		lb.next = (lb.next + 1) % len(lb.dialers)
+		if lb.dialers[i].ready() {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func parseBackendHost(host string, size int) (int, bool) {
+	s, ok := strings.CutPrefix(host, loadBalancerHostPrefix)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || i >= size {
+		return 0, false
+	}
+	return i, true
+}
@@ -0,0 +1,115 @@
+package authproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/int128/kauthproxy/internal/mocks/mock_portforwarder"
+	"github.com/int128/kauthproxy/internal/resolver"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestLoadBalancer_RoundTrip(t *testing.T) {
+	// a request from the browser to the reverse proxy on port 18000
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost:4466/", nil)
+		localAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 18000}
+		return req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, localAddr))
+	}
+	const cookieName = "kauthproxy_backend_18000"
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var gotHosts []string
+	lb := newLoadBalancer(3)
+	lb.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotHosts = append(gotHosts, req.URL.Host)
+		if _, err := req.Cookie(cookieName); err == nil {
+			t.Errorf("cookie %s must not be sent to the upstream", cookieName)
+		}
+		if req.Host != "localhost:4466" {
+			t.Errorf("Host wants localhost:4466 but was %s", req.Host)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}, nil
+	})
+	lb.dialers[0].set(mock_portforwarder.NewMockConnection(ctrl))
+	// backend-1 is reconnecting
+	lb.dialers[2].set(mock_portforwarder.NewMockConnection(ctrl))
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		gotHosts = nil
+		var gotCookies []string
+		for range 3 {
+			req := newRequest()
+			resp, err := lb.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip error: %s", err)
+			}
+			gotCookies = append(gotCookies, resp.Header.Get("Set-Cookie"))
+		}
+		wantHosts := []string{"backend-0:4466", "backend-2:4466", "backend-0:4466"}
+		if !slices.Equal(gotHosts, wantHosts) {
+			t.Errorf("hosts wants %v but was %v", wantHosts, gotHosts)
+		}
+		const wantCookie = cookieName + "=2; Path=/; HttpOnly; SameSite=Lax"
+		if gotCookies[1] != wantCookie {
+			t.Errorf("Set-Cookie wants %s but was %s", wantCookie, gotCookies[1])
+		}
+	})
+	t.Run("Sticky", func(t *testing.T) {
+		gotHosts = nil
+		req := newRequest()
+		req.AddCookie(&http.Cookie{Name: cookieName, Value: "2"})
+		req.AddCookie(&http.Cookie{Name: "session", Value: "foo"})
+		resp, err := lb.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip error: %s", err)
+		}
+		if want := []string{"backend-2:4466"}; !slices.Equal(gotHosts, want) {
+			t.Errorf("hosts wants %v but was %v", want, gotHosts)
+		}
+		if c := resp.Header.Get("Set-Cookie"); c != "" {
+			t.Errorf("Set-Cookie wants empty but was %s", c)
+		}
+	})
+	t.Run("StickyBackendIsNotReady", func(t *testing.T) {
+		gotHosts = nil
+		req := newRequest()
+		req.AddCookie(&http.Cookie{Name: cookieName, Value: "1"})
+		resp, err := lb.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip error: %s", err)
+		}
+		if len(gotHosts) != 1 || gotHosts[0] == "backend-1:4466" {
+			t.Errorf("hosts wants a ready backend but was %v", gotHosts)
+		}
+		if c := resp.Header.Get("Set-Cookie"); c == "" {
+			t.Errorf("Set-Cookie wants non-empty but was empty")
+		}
+	})
+}
+
+func TestLoadBalancer_choose(t *testing.T) {
+	newEndpoint := func(podName string) resolver.Endpoint {
+		return resolver.Endpoint{Pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: podName}}, ContainerPort: 4466}
+	}
+	lb := newLoadBalancer(2)
+	lb.setPodName(0, "pod-a")
+	lb.setPodName(1, "pod-b")
+	got := lb.choose(1, []resolver.Endpoint{newEndpoint("pod-a"), newEndpoint("pod-c")})
+	if got.Pod.Name != "pod-c" {
+		t.Errorf("pod wants pod-c but was %s", got.Pod.Name)
+	}
+}
@@ -0,0 +1,72 @@
+package authproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/int128/kauthproxy/internal/resolver"
+	"github.com/int128/kauthproxy/internal/reverseproxy"
+)
+
+// Route represents a route from the path prefix to the target URL.
+// See reverseproxy.Route for PathPrefix and StripPrefix.
+type Route struct {
+	PathPrefix  string
+	StripPrefix bool
+	// TargetURL is the target in the same form as Option.TargetURL.
+	TargetURL *url.URL
+}
+
+// reverseProxyRoute returns the route to the container port via the transport.
+func (r Route) reverseProxyRoute(rpTransport http.RoundTripper, containerPort int) reverseproxy.Route {
+	return reverseproxy.Route{
+		PathPrefix:   r.PathPrefix,
+		StripPrefix:  r.StripPrefix,
+		Transport:    rpTransport,
+		TargetScheme: r.TargetURL.Scheme,
+		TargetHost:   "localhost",
+		TargetPort:   containerPort,
+	}
+}
+
+// doRoutes runs a port forwarder for each route,
+// and a reverse proxy which forwards a request to the route by the path prefix.
+func (u *AuthProxy) doRoutes(ctx context.Context, o Option, rsv resolver.Interface) error {
+	var backends []backend
+	var routes []reverseproxy.Route
+	for _, r := range o.Routes {
+		t, err := parseTargetURL(o.Namespace, o.NamespaceOverridden, r.TargetURL)
+		if err != nil {
+			return fmt.Errorf("invalid target URL of route %s: %w", r.PathPrefix, err)
+		}
+		b, rpTransport, containerPort, err := u.newBackend(ctx, o, t, rsv)
+		if err != nil {
+			return fmt.Errorf("route %s: %w", r.PathPrefix, err)
+		}
+		u.Logger.V(1).Infof("client -> reverse_proxy%s -> port_forwarder -> pod/%s -> container:%d",
+			r.PathPrefix, b.portForwarderOption.TargetPodName, containerPort)
+		backends = append(backends, b)
+		routes = append(routes, r.reverseProxyRoute(rpTransport, containerPort))
+	}
+	ro := runOption{
+		backends: backends,
+		reverseProxyOption: reverseproxy.Option{
+			BindAddressCandidates: o.BindAddressCandidates,
+			ReadOnly:              o.ReadOnly,
+			Policy:                o.Policy,
+			StripHeaders:          o.StripHeaders,
+			Routes:                routes,
+		},
+		skipOpenBrowser: o.SkipOpenBrowser,
+		tls:             o.TLS,
+		tlsCertificate:  o.tlsCertificate,
+		onReady:         o.onReady,
+		openPath:        o.OpenPath,
+	}
+	if err := u.run(ctx, ro); err != nil {
+		return fmt.Errorf("error while running an authentication proxy: %w", err)
+	}
+	return nil
+}
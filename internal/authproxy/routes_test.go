@@ -0,0 +1,101 @@
+package authproxy
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/int128/kauthproxy/internal/logger/mock_logger"
+	"github.com/int128/kauthproxy/internal/mocks/mock_browser"
+	"github.com/int128/kauthproxy/internal/mocks/mock_portforwarder"
+	"github.com/int128/kauthproxy/internal/mocks/mock_resolver"
+	"github.com/int128/kauthproxy/internal/mocks/mock_reverseproxy"
+	"github.com/int128/kauthproxy/internal/portforwarder"
+	"github.com/int128/kauthproxy/internal/reverseproxy"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAuthProxy_Do_Routes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 500*time.Millisecond)
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	headlampPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "headlamp-12345678", Namespace: "kube-system"}}
+	grafanaPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "grafana-12345678", Namespace: "monitoring"}}
+	mockResolver := mock_resolver.NewMockInterface(ctrl)
+	mockResolver.EXPECT().
+		FindPodByServiceName(gomock.Any(), "kube-system", "headlamp", 0).
+		Return(headlampPod, 4466, nil)
+	mockResolver.EXPECT().
+		FindPodByServiceName(gomock.Any(), "monitoring", "grafana", 0).
+		Return(grafanaPod, 3000, nil)
+	resolverFactory := mock_resolver.NewMockFactoryInterface(ctrl)
+	resolverFactory.EXPECT().
+		New(&restConfig).
+		Return(mockResolver, nil)
+
+	portForwarder := mock_portforwarder.NewMockInterface(ctrl)
+	for _, pod := range []*corev1.Pod{headlampPod, grafanaPod} {
+		portForwarder.EXPECT().
+			Run(gomock.Cond(func(o portforwarder.Option) bool {
+				return o.TargetPodName == pod.Name
+			}), notNil, notNil).
+			DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
+				readyChan <- mock_portforwarder.NewMockConnection(ctrl)
+				<-stopChan
+				return nil
+			})
+	}
+	reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
+	reverseProxy.EXPECT().
+		Run(gomock.Any(), notNil).
+		DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
+			if len(o.Routes) != 2 {
+				t.Errorf("len(Routes) wants 2 but was %d", len(o.Routes))
+				return nil
+			}
+			if r := o.Routes[0]; r.PathPrefix != "/" || r.StripPrefix || r.TargetPort != 4466 || r.TargetScheme != "http" {
+				t.Errorf("Routes[0] mismatch: %+v", r)
+			}
+			if r := o.Routes[1]; r.PathPrefix != "/grafana" || !r.StripPrefix || r.TargetPort != 3000 || r.TargetScheme != "http" {
+				t.Errorf("Routes[1] mismatch: %+v", r)
+			}
+			i := mock_reverseproxy.NewMockInstance(ctrl)
+			i.EXPECT().
+				URL().
+				Return(&url.URL{Scheme: "http", Host: "localhost:8000"})
+			i.EXPECT().
+				Shutdown(notNil).
+				Return(nil)
+			readyChan <- i
+			return nil
+		})
+	browser := mock_browser.NewMockInterface(ctrl)
+	browser.EXPECT().Open(launchURLMatcher)
+	u := &AuthProxy{
+		ReverseProxy:    reverseProxy,
+		PortForwarder:   portForwarder,
+		ResolverFactory: resolverFactory,
+		NewTransport:    newTransport(t),
+		Browser:         browser,
+		Logger:          mock_logger.New(t),
+	}
+	o := Option{
+		Config:                &restConfig,
+		Namespace:             "NAMESPACE",
+		BindAddressCandidates: []string{"127.0.0.1:8000"},
+		Routes: []Route{
+			{PathPrefix: "/", TargetURL: parseURL(t, "http://headlamp.kube-system.svc")},
+			{PathPrefix: "/grafana", StripPrefix: true, TargetURL: parseURL(t, "http://grafana.monitoring.svc")},
+		},
+	}
+	err := u.Do(ctx, o)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err wants context.DeadlineExceeded but was %+v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package authproxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/int128/kauthproxy/internal/resolver"
+	"github.com/int128/kauthproxy/internal/transport"
+)
+
+// defaultCAKey is the key of a CA certificate in a secret or config map,
+// such as a secret of cert-manager or kube-root-ca.crt.
+const defaultCAKey = "ca.crt"
+
+// UpstreamTLSOption represents how to verify the certificate of the upstream pod.
+type UpstreamTLSOption struct {
+	// CAFile is a path to the CA bundle.
+	CAFile string
+	// CASecret and CAConfigMap refer to a CA in the namespace of the target, in form of NAME[:KEY].
+	// KEY defaults to ca.crt.
+	CASecret    string
+	CAConfigMap string
+	// ServerName defaults to the in-cluster DNS name of the service, i.e. NAME.NAMESPACE.svc.
+	ServerName string
+	// Insecure skips the verification.
+	Insecure bool
+}
+
+// newTransportOption returns an option of the transport to verify the upstream and provide a token.
+func (u *AuthProxy) newTransportOption(ctx context.Context, ao Option, t target, rsv resolver.Interface) (transport.Option, error) {
+	ts := ao.tokenSource
+	if ts == nil {
+		var err error
+		ts, err = newTokenSource(ao.UpstreamToken, t, rsv)
+		if err != nil {
+			return transport.Option{}, fmt.Errorf("could not get a token for the upstream: %w", err)
+		}
+	}
+	o := ao.UpstreamTLS
+	to := transport.Option{
+		ServerName:       o.ServerName,
+		Insecure:         o.Insecure,
+		TokenSource:      ts,
+		CredentialHeader: ao.CredentialHeader,
+		Logger:           u.Logger,
+	}
+	if to.ServerName == "" && t.kind == targetKindService {
+		to.ServerName = fmt.Sprintf("%s.%s.svc", t.name, t.namespace)
+	}
+	switch {
+	case o.CAFile != "":
+		b, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return transport.Option{}, fmt.Errorf("could not read the CA file: %w", err)
+		}
+		to.CAData = b
+	case o.CASecret != "":
+		name, key := parseCARef(o.CASecret)
+		b, err := rsv.FindSecretData(ctx, t.namespace, name, key)
+		if err != nil {
+			return transport.Option{}, fmt.Errorf("could not get the CA from the secret: %w", err)
+		}
+		to.CAData = b
+	case o.CAConfigMap != "":
+		name, key := parseCARef(o.CAConfigMap)
+		b, err := rsv.FindConfigMapData(ctx, t.namespace, name, key)
+		if err != nil {
+			return transport.Option{}, fmt.Errorf("could not get the CA from the configmap: %w", err)
+		}
+		to.CAData = b
+	}
+	return to, nil
+}
+
+func parseCARef(s string) (string, string) {
+	name, key, ok := strings.Cut(s, ":")
+	if !ok {
+		return name, defaultCAKey
+	}
+	return name, key
+}
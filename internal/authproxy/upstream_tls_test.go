@@ -0,0 +1,152 @@
+package authproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/int128/kauthproxy/internal/logger/mock_logger"
+	"github.com/int128/kauthproxy/internal/mocks/mock_resolver"
+	"github.com/int128/kauthproxy/internal/resolver"
+	"go.uber.org/mock/gomock"
+)
+
+func TestNewTransportOption(t *testing.T) {
+	t.Run("DefaultServerName", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		u := &AuthProxy{Logger: mock_logger.New(t)}
+		rsv := mock_resolver.NewMockInterface(ctrl)
+		to, err := u.newTransportOption(context.TODO(), Option{},
+			target{kind: targetKindService, namespace: "kube-system", name: "headlamp"}, rsv)
+		if err != nil {
+			t.Fatalf("newTransportOption error: %s", err)
+		}
+		if want := "headlamp.kube-system.svc"; to.ServerName != want {
+			t.Errorf("ServerName wants %s but was %s", want, to.ServerName)
+		}
+		if to.Insecure {
+			t.Errorf("Insecure wants false but was true")
+		}
+	})
+	t.Run("ServerNameOfPod", func(t *testing.T) {
+		for _, tg := range []target{
+			{kind: targetKindPod, namespace: "kube-system", name: "headlamp-12345678"},
+			{kind: targetKindWorkload, workloadKind: resolver.WorkloadKindDeployment, namespace: "kube-system", name: "headlamp"},
+		} {
+			ctrl := gomock.NewController(t)
+			u := &AuthProxy{Logger: mock_logger.New(t)}
+			rsv := mock_resolver.NewMockInterface(ctrl)
+			to, err := u.newTransportOption(context.TODO(), Option{}, tg, rsv)
+			if err != nil {
+				t.Fatalf("newTransportOption error: %s", err)
+			}
+			// verified against the host of the request, i.e. localhost
+			if to.ServerName != "" {
+				t.Errorf("ServerName wants empty but was %s", to.ServerName)
+			}
+			to, err = u.newTransportOption(context.TODO(),
+				Option{UpstreamTLS: UpstreamTLSOption{ServerName: "headlamp.kube-system.svc"}}, tg, rsv)
+			if err != nil {
+				t.Fatalf("newTransportOption error: %s", err)
+			}
+			if want := "headlamp.kube-system.svc"; to.ServerName != want {
+				t.Errorf("ServerName wants %s but was %s", want, to.ServerName)
+			}
+		}
+	})
+	t.Run("CASecret", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		u := &AuthProxy{Logger: mock_logger.New(t)}
+		rsv := mock_resolver.NewMockInterface(ctrl)
+		rsv.EXPECT().
+			FindSecretData(gomock.Any(), "kube-system", "headlamp-tls", "ca.crt").
+			Return([]byte("CA"), nil)
+		to, err := u.newTransportOption(context.TODO(),
+			Option{UpstreamTLS: UpstreamTLSOption{CASecret: "headlamp-tls", ServerName: "headlamp.example.com"}},
+			target{kind: targetKindService, namespace: "kube-system", name: "headlamp"}, rsv)
+		if err != nil {
+			t.Fatalf("newTransportOption error: %s", err)
+		}
+		if string(to.CAData) != "CA" {
+			t.Errorf("CAData wants CA but was %s", to.CAData)
+		}
+		if want := "headlamp.example.com"; to.ServerName != want {
+			t.Errorf("ServerName wants %s but was %s", want, to.ServerName)
+		}
+	})
+	t.Run("CAConfigMapWithKey", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		u := &AuthProxy{Logger: mock_logger.New(t)}
+		rsv := mock_resolver.NewMockInterface(ctrl)
+		rsv.EXPECT().
+			FindConfigMapData(gomock.Any(), "kube-system", "trust-bundle", "bundle.pem").
+			Return([]byte("CA"), nil)
+		to, err := u.newTransportOption(context.TODO(),
+			Option{UpstreamTLS: UpstreamTLSOption{CAConfigMap: "trust-bundle:bundle.pem"}},
+			target{kind: targetKindPod, namespace: "kube-system", name: "headlamp-12345678"}, rsv)
+		if err != nil {
+			t.Fatalf("newTransportOption error: %s", err)
+		}
+		if string(to.CAData) != "CA" {
+			t.Errorf("CAData wants CA but was %s", to.CAData)
+		}
+		if to.ServerName != "" {
+			t.Errorf("ServerName wants empty but was %s", to.ServerName)
+		}
+	})
+	t.Run("ServiceAccountToken", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		u := &AuthProxy{Logger: mock_logger.New(t)}
+		rsv := mock_resolver.NewMockInterface(ctrl)
+		rsv.EXPECT().
+			CreateServiceAccountToken(gomock.Any(), "monitoring", "grafana", []string{"grafana"}, time.Hour).
+			Return("SERVICE_ACCOUNT_TOKEN", time.Now().Add(time.Hour), nil)
+		to, err := u.newTransportOption(context.TODO(),
+			Option{UpstreamToken: UpstreamTokenOption{
+				ServiceAccount:           "monitoring/grafana",
+				ServiceAccountAudiences:  []string{"grafana"},
+				ServiceAccountExpiration: time.Hour,
+			}},
+			target{kind: targetKindService, namespace: "kube-system", name: "grafana"}, rsv)
+		if err != nil {
+			t.Fatalf("newTransportOption error: %s", err)
+		}
+		token, err := to.TokenSource.Token()
+		if err != nil {
+			t.Fatalf("Token error: %s", err)
+		}
+		if token.AccessToken != "SERVICE_ACCOUNT_TOKEN" {
+			t.Errorf("AccessToken wants SERVICE_ACCOUNT_TOKEN but was %s", token.AccessToken)
+		}
+	})
+	t.Run("SharedTokenSource", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		u := &AuthProxy{Logger: mock_logger.New(t)}
+		rsv := mock_resolver.NewMockInterface(ctrl)
+		o := Option{UpstreamToken: UpstreamTokenOption{Command: "echo TOKEN"}}
+		ts, err := newSharedTokenSource(o.UpstreamToken)
+		if err != nil {
+			t.Fatalf("newSharedTokenSource error: %s", err)
+		}
+		o.tokenSource = ts
+		for _, name := range []string{"headlamp", "grafana"} {
+			to, err := u.newTransportOption(context.TODO(), o,
+				target{kind: targetKindService, namespace: "kube-system", name: name}, rsv)
+			if err != nil {
+				t.Fatalf("newTransportOption error: %s", err)
+			}
+			if to.TokenSource != ts {
+				t.Errorf("TokenSource wants the shared token source but was %v", to.TokenSource)
+			}
+		}
+	})
+	t.Run("ServiceAccountTokenIsNotShared", func(t *testing.T) {
+		ts, err := newSharedTokenSource(UpstreamTokenOption{ServiceAccount: "grafana"})
+		if err != nil {
+			t.Fatalf("newSharedTokenSource error: %s", err)
+		}
+		if ts != nil {
+			t.Errorf("token source wants nil but was %v", ts)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package authproxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/int128/kauthproxy/internal/resolver"
+	"github.com/int128/kauthproxy/internal/tokensource"
+	"golang.org/x/oauth2"
+)
+
+// UpstreamTokenOption represents how to get a token to the upstream.
+// If empty, it uses the credential of the cluster.
+type UpstreamTokenOption struct {
+	// File is a path to the token file.
+	File string
+	// Command is a shell command which writes a token to the standard output.
+	Command string
+	// ServiceAccount is a service account to create a token by the TokenRequest API,
+	// in form of NAMESPACE/NAME or NAME in the namespace of the target.
+	ServiceAccount string
+	// ServiceAccountAudiences is the audiences of the token of the service account.
+	// If empty, it defaults to the audience of the API server.
+	ServiceAccountAudiences []string
+	// ServiceAccountExpiration is the lifetime of the token of the service account.
+	// If zero, it defaults to the lifetime of the API server.
+	ServiceAccountExpiration time.Duration
+}
+
+// newTokenSource returns a TokenSource by the option, or nil if not set.
+func newTokenSource(o UpstreamTokenOption, t target, rsv resolver.Interface) (oauth2.TokenSource, error) {
+	switch {
+	case o.File != "":
+		return tokensource.NewFile(o.File), nil
+	case o.Command != "":
+		return tokensource.NewCommand(o.Command), nil
+	case o.ServiceAccount != "":
+		namespace, name, err := parseServiceAccount(o.ServiceAccount, t.namespace)
+		if err != nil {
+			return nil, err
+		}
+		ts := tokensource.NewServiceAccount(rsv, namespace, name, o.ServiceAccountAudiences, o.ServiceAccountExpiration)
+		// create a token at first, to report an error such as forbidden
+		if _, err := ts.Token(); err != nil {
+			return nil, err
+		}
+		return ts, nil
+	}
+	return nil, nil
+}
+
+// newSharedTokenSource returns a token source which does not depend on the target, i.e. a file or command.
+// It returns nil for a service account, because it defaults to the namespace of the target.
+func newSharedTokenSource(o UpstreamTokenOption) (oauth2.TokenSource, error) {
+	if o.ServiceAccount != "" {
+		return nil, nil
+	}
+	return newTokenSource(o, target{}, nil)
+}
+
+func parseServiceAccount(s, defaultNamespace string) (string, string, error) {
+	namespace, name, ok := strings.Cut(s, "/")
+	if !ok {
+		return defaultNamespace, s, nil
+	}
+	if namespace == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("service account must be NAMESPACE/NAME but was %s", s)
+	}
+	return namespace, name, nil
+}
@@ -0,0 +1,53 @@
+package authproxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/int128/kauthproxy/internal/resolver"
+	"github.com/int128/kauthproxy/internal/reverseproxy"
+)
+
+// VirtualHostOption represents an option of the virtual host mode.
+type VirtualHostOption struct {
+	// Scheme is the scheme to access the services.
+	// Defaults to http.
+	Scheme string
+}
+
+// doVirtualHost runs a reverse proxy which forwards a request to the service of the Host header,
+// i.e. NAME.localhost or NAME.NAMESPACE.localhost.
+// The port forwarder to a service is started on the first request.
+func (u *AuthProxy) doVirtualHost(ctx context.Context, o Option, rsv resolver.Interface) error {
+	scheme := o.VirtualHost.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	registry := newBackendRegistry(ctx, u, o, rsv, func(name string) *url.URL {
+		return &url.URL{Scheme: scheme, Host: name + ".svc"}
+	})
+	// stop the port forwarders and wait for them when the reverse proxy is stopped
+	defer registry.wg.Wait()
+	defer cancel()
+	u.Logger.V(1).Infof("client -> reverse_proxy -> NAME.NAMESPACE.localhost -> port_forwarder -> pod")
+	ro := runOption{
+		reverseProxyOption: reverseproxy.Option{
+			BindAddressCandidates: o.BindAddressCandidates,
+			ReadOnly:              o.ReadOnly,
+			Policy:                o.Policy,
+			StripHeaders:          o.StripHeaders,
+			VirtualHost:           &reverseproxy.VirtualHostOption{Route: registry.route},
+		},
+		skipOpenBrowser: o.SkipOpenBrowser,
+		tls:             o.TLS,
+		tlsCertificate:  o.tlsCertificate,
+		onReady:         o.onReady,
+		openPath:        o.OpenPath,
+	}
+	if err := u.run(ctx, ro); err != nil {
+		return fmt.Errorf("error while running an authentication proxy: %w", err)
+	}
+	return nil
+}
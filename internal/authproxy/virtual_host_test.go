@@ -0,0 +1,110 @@
+package authproxy
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/int128/kauthproxy/internal/logger/mock_logger"
+	"github.com/int128/kauthproxy/internal/mocks/mock_browser"
+	"github.com/int128/kauthproxy/internal/mocks/mock_portforwarder"
+	"github.com/int128/kauthproxy/internal/mocks/mock_resolver"
+	"github.com/int128/kauthproxy/internal/mocks/mock_reverseproxy"
+	"github.com/int128/kauthproxy/internal/portforwarder"
+	"github.com/int128/kauthproxy/internal/reverseproxy"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAuthProxy_Do_VirtualHost(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 500*time.Millisecond)
+	defer cancel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	grafanaPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "grafana-12345678", Namespace: "monitoring"}}
+	mockResolver := mock_resolver.NewMockInterface(ctrl)
+	mockResolver.EXPECT().
+		FindPodByServiceName(gomock.Any(), "monitoring", "grafana", 0).
+		Return(grafanaPod, 3000, nil)
+	mockResolver.EXPECT().
+		FindPodByServiceName(gomock.Any(), "NAMESPACE", "unknown", 0).
+		Return(nil, 0, errors.New("service not found")).
+		Times(2)
+	resolverFactory := mock_resolver.NewMockFactoryInterface(ctrl)
+	resolverFactory.EXPECT().
+		New(&restConfig).
+		Return(mockResolver, nil)
+	portForwarder := mock_portforwarder.NewMockInterface(ctrl)
+	portForwarder.EXPECT().
+		Run(gomock.Cond(func(o portforwarder.Option) bool {
+			return o.TargetPodName == grafanaPod.Name && o.TargetContainerPort == 3000
+		}), notNil, notNil).
+		DoAndReturn(func(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
+			readyChan <- mock_portforwarder.NewMockConnection(ctrl)
+			<-stopChan
+			return nil
+		})
+
+	reverseProxy := mock_reverseproxy.NewMockInterface(ctrl)
+	reverseProxy.EXPECT().
+		Run(gomock.Any(), notNil).
+		DoAndReturn(func(o reverseproxy.Option, readyChan chan<- reverseproxy.Instance) error {
+			if o.VirtualHost == nil {
+				t.Errorf("VirtualHost wants non-nil but was nil")
+				return nil
+			}
+			// the port forwarder is started on the first request and reused
+			for range 2 {
+				route, err := o.VirtualHost.Route(context.TODO(), "grafana.monitoring")
+				if err != nil {
+					t.Errorf("Route error: %s", err)
+					return nil
+				}
+				if route.TargetPort != 3000 || route.TargetScheme != "http" {
+					t.Errorf("route mismatch: %+v", route)
+				}
+			}
+			// an error is not cached
+			for range 2 {
+				if _, err := o.VirtualHost.Route(context.TODO(), "unknown"); err == nil {
+					t.Errorf("Route wants an error but was nil")
+				}
+			}
+			if _, err := o.VirtualHost.Route(context.TODO(), "a.b.c"); err == nil {
+				t.Errorf("Route wants an error but was nil")
+			}
+			i := mock_reverseproxy.NewMockInstance(ctrl)
+			i.EXPECT().
+				URL().
+				Return(&url.URL{Scheme: "http", Host: "localhost:8000"})
+			i.EXPECT().
+				Shutdown(notNil).
+				Return(nil)
+			readyChan <- i
+			return nil
+		})
+	browser := mock_browser.NewMockInterface(ctrl)
+	browser.EXPECT().Open(launchURLMatcher)
+	u := &AuthProxy{
+		ReverseProxy:    reverseProxy,
+		PortForwarder:   portForwarder,
+		ResolverFactory: resolverFactory,
+		NewTransport:    newTransport(t),
+		Browser:         browser,
+		Logger:          mock_logger.New(t),
+	}
+	o := Option{
+		Config:                &restConfig,
+		Namespace:             "NAMESPACE",
+		BindAddressCandidates: []string{"127.0.0.1:8000"},
+		VirtualHost:           &VirtualHostOption{},
+	}
+	err := u.Do(ctx, o)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err wants context.DeadlineExceeded but was %+v", err)
+	}
+}
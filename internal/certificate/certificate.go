@@ -0,0 +1,231 @@
+// Package certificate provides a certificate to serve the reverse proxy over HTTPS.
+package certificate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/google/wire"
+	"github.com/int128/kauthproxy/internal/logger"
+)
+
+var Set = wire.NewSet(
+	wire.Struct(new(Certificate), "*"),
+	wire.Bind(new(Interface), new(*Certificate)),
+)
+
+const (
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 365 * 24 * time.Hour
+	// renew the server certificate if it expires within this period
+	serverRenewBefore = 7 * 24 * time.Hour
+)
+
+// Option represents an option of Certificate.
+type Option struct {
+	// CertFile and KeyFile are the certificate provided by the user.
+	// If empty, it generates a certificate signed by the local CA.
+	CertFile string
+	KeyFile  string
+	// CacheDir is the directory to store the generated CA and certificate.
+	// Defaults to kauthproxy in the user config directory.
+	CacheDir string
+}
+
+type Interface interface {
+	Load(o Option) (*tls.Certificate, error)
+}
+
+// Certificate provides a certificate for the loopback addresses.
+type Certificate struct {
+	Logger logger.Interface
+}
+
+// Load returns the certificate provided by the user,
+// or a certificate for 127.0.0.1, ::1 and localhost signed by the local CA.
+//
+// It generates the CA at first time and shows how to trust it.
+// The CA and certificate are cached in the CacheDir.
+func (c *Certificate) Load(o Option) (*tls.Certificate, error) {
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the certificate: %w", err)
+		}
+		return &cert, nil
+	}
+	dir := o.CacheDir
+	if dir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("could not determine the config directory: %w", err)
+		}
+		dir = filepath.Join(configDir, "kauthproxy")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create the directory: %w", err)
+	}
+	caCertFile, caKeyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	ca, err := loadKeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		c.Logger.V(1).Infof("generating a CA: %s", err)
+		ca, err = generateCA()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate a CA: %w", err)
+		}
+		if err := writeKeyPair(ca, caCertFile, caKeyFile); err != nil {
+			return nil, fmt.Errorf("could not write the CA: %w", err)
+		}
+		c.Logger.Printf("Generated a CA at %s", caCertFile)
+		c.Logger.Printf("To trust the CA in the browser, %s", trustInstruction(caCertFile))
+	}
+	serverCertFile, serverKeyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	server, err := loadKeyPair(serverCertFile, serverKeyFile)
+	if err == nil && time.Now().Add(serverRenewBefore).After(server.cert.NotAfter) {
+		err = errors.New("the certificate expires soon")
+	}
+	if err == nil && server.cert.CheckSignatureFrom(ca.cert) != nil {
+		err = errors.New("the certificate is not signed by the CA")
+	}
+	if err != nil {
+		c.Logger.V(1).Infof("generating a server certificate: %s", err)
+		server, err = generateServerCertificate(ca)
+		if err != nil {
+			return nil, fmt.Errorf("could not generate a server certificate: %w", err)
+		}
+		if err := writeKeyPair(server, serverCertFile, serverKeyFile); err != nil {
+			return nil, fmt.Errorf("could not write the server certificate: %w", err)
+		}
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{server.cert.Raw, ca.cert.Raw},
+		PrivateKey:  server.key,
+		Leaf:        server.cert,
+	}, nil
+}
+
+func trustInstruction(caCertFile string) string {
+	switch runtime.GOOS {
+	case "darwin":
+		return fmt.Sprintf("run: security add-trusted-cert -r trustRoot -k ~/Library/Keychains/login.keychain-db %s", caCertFile)
+	case "windows":
+		return fmt.Sprintf("run: certutil -user -addstore Root %s", caCertFile)
+	default:
+		return fmt.Sprintf("import %s into the browser or the system trust store (e.g. update-ca-certificates)", caCertFile)
+	}
+}
+
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func generateCA() (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate a key: %w", err)
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("kauthproxy local CA (%s)", hostname)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create a certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the certificate: %w", err)
+	}
+	return &keyPair{cert: cert, key: key}, nil
+}
+
+func generateServerCertificate(ca *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate a key: %w", err)
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(serverValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create a certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the certificate: %w", err)
+	}
+	return &keyPair{cert: cert, key: key}, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("could not generate a serial number: %w", err)
+	}
+	return serialNumber, nil
+}
+
+func loadKeyPair(certFile, keyFile string) (*keyPair, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unknown type of private key %T", pair.PrivateKey)
+	}
+	return &keyPair{cert: pair.Leaf, key: key}, nil
+}
+
+func writeKeyPair(pair *keyPair, certFile, keyFile string) error {
+	keyDER, err := x509.MarshalECPrivateKey(pair.key)
+	if err != nil {
+		return fmt.Errorf("could not marshal the key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("could not write the key: %w", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pair.cert.Raw})
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("could not write the certificate: %w", err)
+	}
+	return nil
+}
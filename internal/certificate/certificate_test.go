@@ -0,0 +1,61 @@
+package certificate
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/int128/kauthproxy/internal/logger/mock_logger"
+)
+
+func TestCertificate_Load(t *testing.T) {
+	t.Run("Generate", func(t *testing.T) {
+		dir := t.TempDir()
+		c := &Certificate{Logger: mock_logger.New(t)}
+		cert, err := c.Load(Option{CacheDir: dir})
+		if err != nil {
+			t.Fatalf("Load error: %s", err)
+		}
+		caPEM, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+		if err != nil {
+			t.Fatalf("could not read the CA: %s", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			t.Fatalf("could not parse the CA")
+		}
+		for _, host := range []string{"127.0.0.1", "::1", "localhost"} {
+			if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+				t.Errorf("certificate for %s is not valid: %s", host, err)
+			}
+		}
+
+		t.Run("ReuseCache", func(t *testing.T) {
+			cached, err := c.Load(Option{CacheDir: dir})
+			if err != nil {
+				t.Fatalf("Load error: %s", err)
+			}
+			if cached.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+				t.Errorf("serial number wants %s but was %s", cert.Leaf.SerialNumber, cached.Leaf.SerialNumber)
+			}
+		})
+	})
+	t.Run("UserProvided", func(t *testing.T) {
+		dir := t.TempDir()
+		c := &Certificate{Logger: mock_logger.New(t)}
+		if _, err := c.Load(Option{CacheDir: dir}); err != nil {
+			t.Fatalf("Load error: %s", err)
+		}
+		cert, err := c.Load(Option{
+			CertFile: filepath.Join(dir, "server.crt"),
+			KeyFile:  filepath.Join(dir, "server.key"),
+		})
+		if err != nil {
+			t.Fatalf("Load error: %s", err)
+		}
+		if len(cert.Certificate) != 1 {
+			t.Errorf("len(Certificate) wants 1 but was %d", len(cert.Certificate))
+		}
+	})
+}
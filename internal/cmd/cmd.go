@@ -5,14 +5,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/wire"
 	"github.com/int128/kauthproxy/internal/authproxy"
+	"github.com/int128/kauthproxy/internal/certificate"
 	"github.com/int128/kauthproxy/internal/logger"
+	"github.com/int128/kauthproxy/internal/portforwarder"
+	"github.com/int128/kauthproxy/internal/reverseproxy"
+	"github.com/int128/kauthproxy/internal/transport"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"sigs.k8s.io/yaml"
 )
 
 var Set = wire.NewSet(
@@ -59,28 +69,109 @@ type rootCmdOptions struct {
 	k8sOptions        *genericclioptions.ConfigFlags
 	addressCandidates []string
 	skipOpenBrowser   bool
+	scheme            string
+	mode              string
+	protocol          string
+	loadBalance       int
+	tls               bool
+	tlsCertFile       string
+	tlsKeyFile        string
+	upstreamTLS       authproxy.UpstreamTLSOption
+	readOnly          bool
+	webSocketPaths    []string
+	policyFile        string
+	stripHeaders      []string
+	upstreamToken     authproxy.UpstreamTokenOption
+	credentialHeader  transport.CredentialHeaderOption
+	targetsFile       string
+	openPath          string
+	configFile        string
+	profile           string
+	routes            []string
+	keepPrefixRoutes  []string
+	virtualHost       bool
+	forwardProxy      bool
 }
 
 func (o *rootCmdOptions) addFlags(f *pflag.FlagSet) {
 	o.k8sOptions.AddFlags(f)
-	f.StringArrayVar(&o.addressCandidates, "address", defaultAddress, "The address on which to run the proxy. If set multiple times, it will try binding the address in order")
+	f.StringArrayVar(&o.addressCandidates, "address", defaultAddress, "The address on which to run the proxy. If set multiple times, it will try binding the address in order. For multiple targets, the port is incremented for each target")
+	f.StringArrayVar(&o.routes, "route", nil, "Route in form of PREFIX=URL to forward the requests under the path prefix to the target behind a single address. The prefix is removed before forwarding (can be set multiple times)")
+	f.StringArrayVar(&o.keepPrefixRoutes, "route-keep-prefix", nil, "Route in form of PREFIX=URL like --route, but the prefix is kept for the target serving under a sub path (can be set multiple times)")
+	f.BoolVar(&o.virtualHost, "virtual-host", false, "If set, forward a request to the service of the host NAME.NAMESPACE.localhost or NAME.localhost on a single port")
+	f.BoolVar(&o.forwardProxy, "forward-proxy", false, "If set, run an HTTP proxy to forward a request to the service of the host NAME.NAMESPACE.svc")
+	f.StringVar(&o.targetsFile, "targets-file", "", "Path to a file (YAML) of the targets to proxy in addition to the arguments")
 	f.BoolVar(&o.skipOpenBrowser, "skip-open-browser", false, "If set, skip opening the browser")
+	f.StringVar(&o.openPath, "open-path", "", "Path to open in the browser, e.g. /c/main/pods (default the top)")
+	f.StringVar(&o.profile, "profile", "", "Name of the profile in the config file. The flags override the values of the profile")
+	f.StringVar(&o.configFile, "config", "", "Path to the config file of the profiles (default config.yaml in the kauthproxy directory of the user config, e.g. ~/.config/kauthproxy/config.yaml)")
+	f.StringVar(&o.scheme, "scheme", "http", "The scheme to access the target given as TYPE/NAME or --virtual-host")
+	f.StringVar(&o.mode, "mode", string(authproxy.ModePortForward),
+		fmt.Sprintf("How to reach the target, one of (%s, %s)", authproxy.ModePortForward, authproxy.ModeServiceProxy))
+	f.IntVar(&o.loadBalance, "load-balance", 0, "If set to 2 or more, distribute requests across the number of ready pods behind the service")
+	f.BoolVar(&o.tls, "tls", false, "If set, serve the proxy over HTTPS with a certificate signed by the local CA")
+	f.StringVar(&o.tlsCertFile, "tls-cert-file", "", "Path to a certificate file to serve the proxy over HTTPS (implies --tls)")
+	f.StringVar(&o.tlsKeyFile, "tls-key-file", "", "Path to a private key file to serve the proxy over HTTPS (implies --tls)")
+	f.StringVar(&o.upstreamTLS.CAFile, "upstream-ca-file", "", "Path to a CA bundle to verify the upstream over HTTPS")
+	f.StringVar(&o.upstreamTLS.CASecret, "upstream-ca-secret", "", "Secret in the namespace of the target to verify the upstream over HTTPS, in form of NAME[:KEY] (default key ca.crt)")
+	f.StringVar(&o.upstreamTLS.CAConfigMap, "upstream-ca-configmap", "", "ConfigMap in the namespace of the target to verify the upstream over HTTPS, in form of NAME[:KEY] (default key ca.crt)")
+	f.StringVar(&o.upstreamTLS.ServerName, "upstream-server-name", "", "Server name to verify the upstream over HTTPS (default NAME.NAMESPACE.svc of the service, or localhost of a pod or workload)")
+	f.BoolVar(&o.upstreamTLS.Insecure, "upstream-insecure", false, "If set, skip the verification of the upstream over HTTPS")
+	f.BoolVar(&o.readOnly, "read-only", false, "If set, forward only GET, HEAD and OPTIONS requests")
+	f.StringArrayVar(&o.webSocketPaths, "read-only-websocket-path", nil, "Path pattern to allow WebSocket in the read-only mode, e.g. /api/ws or /stream/** (can be set multiple times)")
+	f.StringVar(&o.policyFile, "policy", "", "Path to a policy file (YAML) to allow or deny requests by method, path and headers")
+	f.StringVar(&o.upstreamToken.File, "token-file", "", "Path to a token file for the upstream, instead of the credential of the cluster")
+	f.StringVar(&o.upstreamToken.Command, "token-command", "", "Shell command to print a token for the upstream, instead of the credential of the cluster")
+	f.StringVar(&o.upstreamToken.ServiceAccount, "as-service-account", "", "Service account to create a token for the upstream, in form of NAMESPACE/NAME or NAME in the namespace of the target")
+	f.StringArrayVar(&o.upstreamToken.ServiceAccountAudiences, "service-account-audience", nil, "Audience of the token of --as-service-account (default the audience of the API server)")
+	f.DurationVar(&o.upstreamToken.ServiceAccountExpiration, "service-account-token-expiration", time.Hour, "Lifetime of the token of --as-service-account")
+	f.StringVar(&o.credentialHeader.Name, "credential-header", "", "Header to send the token to the upstream, e.g. X-Forwarded-Access-Token (default Authorization)")
+	f.StringVar(&o.credentialHeader.Template, "credential-header-template", transport.DefaultCredentialHeaderTemplate, "Value of --credential-header in Go template, e.g. 'Bearer {{.Token}}'")
+	f.BoolVar(&o.credentialHeader.KeepAuthorization, "keep-authorization-header", false, "If set, send the Authorization header as well as --credential-header")
+	f.StringArrayVar(&o.stripHeaders, "strip-header", nil,
+		fmt.Sprintf("Header to remove from a request in addition to the defaults (%s). A name ending with * matches to the prefix", strings.Join(reverseproxy.DefaultStripHeaders, ", ")))
+	f.StringVar(&o.protocol, "port-forward-protocol", string(portforwarder.ProtocolAuto),
+		fmt.Sprintf("Protocol of port forwarding, one of (%s, %s, %s)", portforwarder.ProtocolAuto, portforwarder.ProtocolWebSocket, portforwarder.ProtocolSPDY))
 }
 
 func (cmd *Cmd) newRootCmd() *cobra.Command {
 	var o rootCmdOptions
 	o.k8sOptions = genericclioptions.NewConfigFlags(false)
 	c := &cobra.Command{
-		Use:   "kubectl auth-proxy POD_OR_SERVICE_URL",
+		Use:   "kubectl auth-proxy URL | TYPE/NAME[:PORT]... | PROFILE",
 		Short: "Forward a local port to a pod or service via the authentication proxy",
 		Long: `Forward a local port to a pod or service via the authentication proxy.
 It gets a token from the current credential plugin (e.g. EKS, OpenID Connect).
 Then it appends the authorization header to HTTP requests, like "authorization: Bearer token".
 All traffic is routed by the authentication proxy and port forwarder as follows:
   [browser] -> [authentication proxy] -> [port forwarder] -> [pod]`,
-		Example: `kubectl auth-proxy http://headlamp.svc`,
-		Args:    cobra.ExactArgs(1),
+		Example: `  # Forward to a service
+  kubectl auth-proxy http://headlamp.svc
+
+  # Forward to a ready pod of a deployment
+  kubectl auth-proxy http://deploy.headlamp
+  kubectl auth-proxy deployment/headlamp:4466
+
+  # Forward to multiple services on the consecutive ports
+  kubectl auth-proxy http://headlamp.svc http://grafana.monitoring.svc
+
+  # Forward to multiple services on a single port by the path
+  kubectl auth-proxy --route /=http://headlamp.kube-system.svc --route /grafana=http://grafana.monitoring.svc
+
+  # Forward to the service of the host, e.g. http://grafana.monitoring.localhost:18000
+  kubectl auth-proxy --virtual-host
+
+  # Run an HTTP proxy for the services, e.g. http://grafana.monitoring.svc
+  kubectl auth-proxy --forward-proxy
+
+  # Run with the profile in ~/.config/kauthproxy/config.yaml
+  kubectl auth-proxy grafana-prod`,
+		Args: cobra.ArbitraryArgs,
 		RunE: func(c *cobra.Command, args []string) error {
+			args, err := cmd.applyProfile(c.Flags(), o.configFile, o.profile, args)
+			if err != nil {
+				return err
+			}
 			return cmd.runRootCmd(c.Context(), o, args)
 		},
 	}
@@ -90,27 +181,341 @@ All traffic is routed by the authentication proxy and port forwarder as follows:
 }
 
 func (cmd *Cmd) runRootCmd(ctx context.Context, o rootCmdOptions, args []string) error {
-	remoteURL, err := url.Parse(args[0])
+	mode := authproxy.Mode(o.mode)
+	if mode != authproxy.ModePortForward && mode != authproxy.ModeServiceProxy {
+		return fmt.Errorf("unknown mode %s", o.mode)
+	}
+	protocol := portforwarder.Protocol(o.protocol)
+	switch protocol {
+	case portforwarder.ProtocolAuto, portforwarder.ProtocolWebSocket, portforwarder.ProtocolSPDY:
+	default:
+		return fmt.Errorf("unknown port forward protocol %s", o.protocol)
+	}
+	if (o.tlsCertFile == "") != (o.tlsKeyFile == "") {
+		return fmt.Errorf("both --tls-cert-file and --tls-key-file must be set")
+	}
+	if err := validateUpstreamTLS(o.upstreamTLS); err != nil {
+		return err
+	}
+	if err := validateUpstreamToken(o.upstreamToken); err != nil {
+		return err
+	}
+	if mode == authproxy.ModeServiceProxy {
+		if err := validateServiceProxy(o); err != nil {
+			return err
+		}
+	}
+	routes, err := parseRoutes(o)
 	if err != nil {
-		return fmt.Errorf("invalid remote URL: %w", err)
+		return err
+	}
+	var targets []target
+	switch {
+	case o.forwardProxy:
+		if len(args) > 0 || o.targetsFile != "" || len(routes) > 0 || o.virtualHost {
+			return fmt.Errorf("--forward-proxy cannot be used with a target URL, --targets-file, --route or --virtual-host")
+		}
+		if mode != authproxy.ModePortForward || o.loadBalance > 1 {
+			return fmt.Errorf("--forward-proxy supports only --mode=%s without --load-balance", authproxy.ModePortForward)
+		}
+		if o.tls || o.tlsCertFile != "" {
+			return fmt.Errorf("--forward-proxy does not support --tls")
+		}
+	case o.virtualHost:
+		if len(args) > 0 || o.targetsFile != "" || len(routes) > 0 {
+			return fmt.Errorf("--virtual-host cannot be used with a target URL, --targets-file or --route")
+		}
+		if mode != authproxy.ModePortForward || o.loadBalance > 1 {
+			return fmt.Errorf("--virtual-host supports only --mode=%s without --load-balance", authproxy.ModePortForward)
+		}
+		if o.tls || o.tlsCertFile != "" {
+			return fmt.Errorf("--virtual-host does not support --tls, because the certificate does not cover the subdomains of localhost")
+		}
+	case len(routes) > 0:
+		if len(args) > 0 || o.targetsFile != "" {
+			return fmt.Errorf("--route cannot be used with a target URL or --targets-file")
+		}
+		if mode != authproxy.ModePortForward || o.loadBalance > 1 {
+			return fmt.Errorf("--route supports only --mode=%s without --load-balance", authproxy.ModePortForward)
+		}
+	default:
+		targets, err = cmd.loadTargets(o, args)
+		if err != nil {
+			return err
+		}
 	}
 	config, err := o.k8sOptions.ToRESTConfig()
 	if err != nil {
 		return fmt.Errorf("could not load the config: %w", err)
 	}
-	namespace, _, err := o.k8sOptions.ToRawKubeConfigLoader().Namespace()
+	namespace, namespaceOverridden, err := o.k8sOptions.ToRawKubeConfigLoader().Namespace()
 	if err != nil {
 		return fmt.Errorf("could not determine the namespace: %w", err)
 	}
 	authProxyOption := authproxy.Option{
-		Config:                config,
-		Namespace:             namespace,
-		TargetURL:             remoteURL,
-		BindAddressCandidates: o.addressCandidates,
-		SkipOpenBrowser:       o.skipOpenBrowser,
+		Config:              config,
+		Namespace:           namespace,
+		NamespaceOverridden: namespaceOverridden,
+		SkipOpenBrowser:     o.skipOpenBrowser,
+		OpenPath:            o.openPath,
+		Mode:                mode,
+		PortForwardProtocol: protocol,
+		LoadBalance:         o.loadBalance,
+		UpstreamTLS:         o.upstreamTLS,
+		StripHeaders:        o.stripHeaders,
+		UpstreamToken:       o.upstreamToken,
+		CredentialHeader:    o.credentialHeader,
+	}
+	if o.readOnly {
+		authProxyOption.ReadOnly = &reverseproxy.ReadOnlyOption{WebSocketPaths: o.webSocketPaths}
+	} else if len(o.webSocketPaths) > 0 {
+		return fmt.Errorf("--read-only-websocket-path requires --read-only")
 	}
-	if err := cmd.AuthProxy.Do(ctx, authProxyOption); err != nil {
+	if o.policyFile != "" {
+		policy, err := loadPolicy(o.policyFile)
+		if err != nil {
+			return fmt.Errorf("could not load the policy: %w", err)
+		}
+		cmd.Logger.V(1).Infof("loaded %d rule(s) from the policy %s", len(policy.Rules), o.policyFile)
+		authProxyOption.Policy = policy
+	}
+	if o.tls || o.tlsCertFile != "" {
+		authProxyOption.TLS = &certificate.Option{
+			CertFile: o.tlsCertFile,
+			KeyFile:  o.tlsKeyFile,
+		}
+	}
+	if o.forwardProxy || o.virtualHost || len(routes) > 0 {
+		authProxyOption.Routes = routes
+		if o.virtualHost {
+			authProxyOption.VirtualHost = &authproxy.VirtualHostOption{Scheme: o.scheme}
+		}
+		authProxyOption.ForwardProxy = o.forwardProxy
+		authProxyOption.BindAddressCandidates = o.addressCandidates
+		if err := cmd.AuthProxy.Do(ctx, authProxyOption); err != nil {
+			return fmt.Errorf("could not run an authentication proxy: %w", err)
+		}
+		return nil
+	}
+	var authProxyOptions []authproxy.Option
+	for _, t := range targets {
+		targetOption := authProxyOption
+		targetOption.TargetURL = t.url
+		targetOption.BindAddressCandidates = t.addressCandidates
+		authProxyOptions = append(authProxyOptions, targetOption)
+	}
+	if err := cmd.AuthProxy.DoAll(ctx, authProxyOptions); err != nil {
 		return fmt.Errorf("could not run an authentication proxy: %w", err)
 	}
 	return nil
 }
+
+// parseRoutes parses --route and --route-keep-prefix in form of PREFIX=URL.
+func parseRoutes(o rootCmdOptions) ([]authproxy.Route, error) {
+	var routes []authproxy.Route
+	parse := func(flagName string, values []string, stripPrefix bool) error {
+		for _, v := range values {
+			prefix, arg, ok := strings.Cut(v, "=")
+			if !ok || !strings.HasPrefix(prefix, "/") {
+				return fmt.Errorf("--%s must be in form of PREFIX=URL: %s", flagName, v)
+			}
+			u, err := parseTarget(arg, o.scheme)
+			if err != nil {
+				return fmt.Errorf("invalid URL of --%s %s: %w", flagName, prefix, err)
+			}
+			routes = append(routes, authproxy.Route{PathPrefix: prefix, StripPrefix: stripPrefix, TargetURL: u})
+		}
+		return nil
+	}
+	if err := parse("route", o.routes, true); err != nil {
+		return nil, err
+	}
+	if err := parse("route-keep-prefix", o.keepPrefixRoutes, false); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+type target struct {
+	url               *url.URL
+	addressCandidates []string
+}
+
+// loadTargets returns the targets given by the arguments and the targets file.
+// The port of the address candidates is incremented for each target,
+// unless the address is given by the targets file.
+func (cmd *Cmd) loadTargets(o rootCmdOptions, args []string) ([]target, error) {
+	var targets []target
+	for _, arg := range args {
+		u, err := parseTarget(arg, o.scheme)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote URL: %w", err)
+		}
+		targets = append(targets, target{url: u})
+	}
+	if o.targetsFile != "" {
+		f, err := loadTargetsFile(o.targetsFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the targets: %w", err)
+		}
+		cmd.Logger.V(1).Infof("loaded %d target(s) from %s", len(f.Targets), o.targetsFile)
+		for _, t := range f.Targets {
+			u, err := parseTarget(t.URL, o.scheme)
+			if err != nil {
+				return nil, fmt.Errorf("invalid remote URL in %s: %w", o.targetsFile, err)
+			}
+			targets = append(targets, target{url: u, addressCandidates: t.Address})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("target URL or --targets-file must be given")
+	}
+	for i := range targets {
+		if targets[i].addressCandidates == nil {
+			addressCandidates, err := offsetPort(o.addressCandidates, i)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address: %w", err)
+			}
+			targets[i].addressCandidates = addressCandidates
+		}
+	}
+	return targets, nil
+}
+
+// targetsFile represents a file of the targets, for example,
+//
+//	targets:
+//	  - url: http://headlamp.svc
+//	  - url: deployment/grafana:3000
+//	    address: [127.0.0.1:13000]
+type targetsFile struct {
+	Targets []struct {
+		// URL is a URL or TYPE/NAME[:PORT]
+		URL string `json:"url"`
+		// Address is the address candidates on which to run the proxy.
+		// Defaults to --address with the incremented port.
+		Address []string `json:"address,omitempty"`
+	} `json:"targets"`
+}
+
+func loadTargetsFile(name string) (*targetsFile, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the file: %w", err)
+	}
+	var f targetsFile
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("invalid targets file %s: %w", name, err)
+	}
+	return &f, nil
+}
+
+// offsetPort returns the addresses with the port incremented by the offset.
+// An address with port 0 is kept as-is.
+func offsetPort(addresses []string, offset int) ([]string, error) {
+	if offset == 0 {
+		return addresses, nil
+	}
+	var offsetAddresses []string
+	for _, address := range addresses {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %w", address, err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port of address %s: %w", address, err)
+		}
+		if p != 0 {
+			p += offset
+		}
+		offsetAddresses = append(offsetAddresses, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+	return offsetAddresses, nil
+}
+
+func loadPolicy(name string) (*reverseproxy.Policy, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the file: %w", err)
+	}
+	policy, err := reverseproxy.ParsePolicy(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", name, err)
+	}
+	return policy, nil
+}
+
+func validateUpstreamToken(o authproxy.UpstreamTokenOption) error {
+	var n int
+	for _, v := range []string{o.File, o.Command, o.ServiceAccount} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("only one of --token-file, --token-command or --as-service-account can be set")
+	}
+	return nil
+}
+
+// validateServiceProxy returns an error if a flag is not supported in the service-proxy mode,
+// because the API server connects to the upstream with the credential of the cluster.
+func validateServiceProxy(o rootCmdOptions) error {
+	var flags []string
+	if o.loadBalance > 1 {
+		flags = append(flags, "--load-balance")
+	}
+	if o.upstreamToken.File != "" || o.upstreamToken.Command != "" || o.upstreamToken.ServiceAccount != "" {
+		flags = append(flags, "--token-file, --token-command or --as-service-account")
+	}
+	if o.upstreamTLS != (authproxy.UpstreamTLSOption{}) {
+		flags = append(flags, "--upstream-*")
+	}
+	if o.credentialHeader != (transport.CredentialHeaderOption{Template: transport.DefaultCredentialHeaderTemplate}) {
+		flags = append(flags, "--credential-header, --credential-header-template or --keep-authorization-header")
+	}
+	if len(flags) > 0 {
+		return fmt.Errorf("--mode=%s does not support %s", authproxy.ModeServiceProxy, strings.Join(flags, ", "))
+	}
+	return nil
+}
+
+func validateUpstreamTLS(o authproxy.UpstreamTLSOption) error {
+	var caFlags int
+	for _, v := range []string{o.CAFile, o.CASecret, o.CAConfigMap} {
+		if v != "" {
+			caFlags++
+		}
+	}
+	if caFlags > 1 {
+		return fmt.Errorf("only one of --upstream-ca-file, --upstream-ca-secret or --upstream-ca-configmap can be set")
+	}
+	if caFlags > 0 && o.Insecure {
+		return fmt.Errorf("--upstream-insecure cannot be used with a CA")
+	}
+	return nil
+}
+
+// parseTarget parses the argument as a URL or TYPE/NAME[:PORT].
+// TYPE/NAME is converted to the URL form, e.g. deployment/headlamp to http://deployment.headlamp.
+func parseTarget(arg, scheme string) (*url.URL, error) {
+	if strings.Contains(arg, "://") {
+		return url.Parse(arg)
+	}
+	resourceType, name, ok := strings.Cut(arg, "/")
+	if !ok {
+		return nil, fmt.Errorf("target must be URL or TYPE/NAME: %s", arg)
+	}
+	switch resourceType {
+	case "svc", "service":
+		host, port, hasPort := strings.Cut(name, ":")
+		if hasPort {
+			return url.Parse(fmt.Sprintf("%s://%s.svc:%s", scheme, host, port))
+		}
+		return url.Parse(fmt.Sprintf("%s://%s.svc", scheme, host))
+	case "pod", "po", "deploy", "deployment", "sts", "statefulset", "ds", "daemonset":
+		return url.Parse(fmt.Sprintf("%s://%s.%s", scheme, resourceType, name))
+	}
+	return nil, fmt.Errorf("unknown resource type %s", resourceType)
+}
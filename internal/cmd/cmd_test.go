@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+func TestValidateServiceProxy(t *testing.T) {
+	parse := func(t *testing.T, osArgs ...string) rootCmdOptions {
+		var o rootCmdOptions
+		o.k8sOptions = genericclioptions.NewConfigFlags(false)
+		f := pflag.NewFlagSet("", pflag.ContinueOnError)
+		o.addFlags(f)
+		if err := f.Parse(osArgs); err != nil {
+			t.Fatalf("could not parse the flags: %s", err)
+		}
+		return o
+	}
+
+	t.Run("Supported", func(t *testing.T) {
+		o := parse(t, "--mode=service-proxy", "--read-only", "--tls")
+		if err := validateServiceProxy(o); err != nil {
+			t.Errorf("validateServiceProxy wants nil but was %s", err)
+		}
+	})
+	for _, flag := range []string{
+		"--load-balance=2",
+		"--token-command=echo",
+		"--as-service-account=headlamp",
+		"--upstream-insecure",
+		"--upstream-server-name=headlamp",
+		"--credential-header=X-Forwarded-Access-Token",
+		"--keep-authorization-header",
+	} {
+		t.Run(flag, func(t *testing.T) {
+			o := parse(t, "--mode=service-proxy", flag)
+			if err := validateServiceProxy(o); err == nil {
+				t.Errorf("validateServiceProxy wants an error but was nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// configFile represents the config file, for example,
+//
+//	profiles:
+//	  grafana-prod:
+//	    context: prod
+//	    namespace: monitoring
+//	    url: http://grafana.svc
+//	    openPath: /dashboards
+type configFile struct {
+	Profiles map[string]profile `json:"profiles"`
+}
+
+// profile represents a set of the default values of flags.
+// A relative path in the profile is resolved from the directory of the config file.
+type profile struct {
+	Context                  string   `json:"context,omitempty"`
+	Namespace                string   `json:"namespace,omitempty"`
+	URL                      string   `json:"url,omitempty"`
+	Address                  []string `json:"address,omitempty"`
+	OpenPath                 string   `json:"openPath,omitempty"`
+	SkipOpenBrowser          *bool    `json:"skipOpenBrowser,omitempty"`
+	TLS                      *bool    `json:"tls,omitempty"`
+	ReadOnly                 *bool    `json:"readOnly,omitempty"`
+	ReadOnlyWebSocketPaths   []string `json:"readOnlyWebSocketPaths,omitempty"`
+	Policy                   string   `json:"policy,omitempty"`
+	StripHeaders             []string `json:"stripHeaders,omitempty"`
+	CredentialHeader         string   `json:"credentialHeader,omitempty"`
+	CredentialHeaderTemplate string   `json:"credentialHeaderTemplate,omitempty"`
+	KeepAuthorizationHeader  *bool    `json:"keepAuthorizationHeader,omitempty"`
+}
+
+// flagValues returns the values of the profile by the flag names.
+func (p profile) flagValues(dir string) map[string][]string {
+	values := map[string][]string{}
+	setString := func(name, v string) {
+		if v != "" {
+			values[name] = []string{v}
+		}
+	}
+	setBool := func(name string, v *bool) {
+		if v != nil {
+			values[name] = []string{strconv.FormatBool(*v)}
+		}
+	}
+	setStrings := func(name string, v []string) {
+		if len(v) > 0 {
+			values[name] = v
+		}
+	}
+	setString("context", p.Context)
+	setString("namespace", p.Namespace)
+	setStrings("address", p.Address)
+	setString("open-path", p.OpenPath)
+	setBool("skip-open-browser", p.SkipOpenBrowser)
+	setBool("tls", p.TLS)
+	setBool("read-only", p.ReadOnly)
+	setStrings("read-only-websocket-path", p.ReadOnlyWebSocketPaths)
+	if p.Policy != "" {
+		setString("policy", resolvePath(dir, p.Policy))
+	}
+	setStrings("strip-header", p.StripHeaders)
+	setString("credential-header", p.CredentialHeader)
+	setString("credential-header-template", p.CredentialHeaderTemplate)
+	setBool("keep-authorization-header", p.KeepAuthorizationHeader)
+	return values
+}
+
+func resolvePath(dir, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// defaultConfigFile returns the path to config.yaml in the user config directory,
+// e.g. ~/.config/kauthproxy/config.yaml.
+func defaultConfigFile() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine the config directory: %w", err)
+	}
+	return filepath.Join(configDir, "kauthproxy", "config.yaml"), nil
+}
+
+func loadConfigFile(name string) (*configFile, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the file: %w", err)
+	}
+	var c configFile
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", name, err)
+	}
+	return &c, nil
+}
+
+// isProfileName returns true if the argument is not a URL or TYPE/NAME.
+func isProfileName(arg string) bool {
+	return !strings.Contains(arg, "/")
+}
+
+// applyProfile sets the values of the profile to the flags which are not given by the command line.
+// The profile is given by profileName, or the argument if it is not a URL or TYPE/NAME.
+// It returns the arguments, which contain the URL of the profile if no argument is given.
+func (cmd *Cmd) applyProfile(f *pflag.FlagSet, configFileName, profileName string, args []string) ([]string, error) {
+	if profileName == "" && len(args) == 1 && isProfileName(args[0]) {
+		profileName, args = args[0], nil
+	}
+	if profileName == "" {
+		return args, nil
+	}
+	if configFileName == "" {
+		name, err := defaultConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		configFileName = name
+	}
+	c, err := loadConfigFile(configFileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the profile %s: %w", profileName, err)
+	}
+	p, ok := c.Profiles[profileName]
+	if !ok {
+		var names []string
+		for name := range c.Profiles {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return nil, fmt.Errorf("no such profile %s in %s (available: %s)", profileName, configFileName, strings.Join(names, ", "))
+	}
+	cmd.Logger.Printf("Using the profile %s in %s", profileName, configFileName)
+	for name, values := range p.flagValues(filepath.Dir(configFileName)) {
+		if f.Changed(name) {
+			cmd.Logger.V(1).Infof("flag --%s overrides the profile", name)
+			continue
+		}
+		for _, v := range values {
+			if err := f.Set(name, v); err != nil {
+				return nil, fmt.Errorf("invalid %s in the profile %s: %w", name, profileName, err)
+			}
+		}
+	}
+	if len(args) == 0 && p.URL != "" {
+		args = []string{p.URL}
+	}
+	return args, nil
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/int128/kauthproxy/internal/logger/mock_logger"
+	"github.com/spf13/pflag"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+const testConfigFile = `
+profiles:
+  grafana-prod:
+    context: prod
+    namespace: monitoring
+    url: http://grafana.svc
+    address: [127.0.0.1:13000]
+    openPath: /dashboards
+    readOnly: true
+    policy: policy.yaml
+`
+
+func TestCmd_applyProfile(t *testing.T) {
+	dir := t.TempDir()
+	configFileName := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFileName, []byte(testConfigFile), 0600); err != nil {
+		t.Fatalf("could not write the config file: %s", err)
+	}
+	newFlags := func(t *testing.T, osArgs ...string) (*rootCmdOptions, *pflag.FlagSet) {
+		var o rootCmdOptions
+		o.k8sOptions = genericclioptions.NewConfigFlags(false)
+		f := pflag.NewFlagSet("", pflag.ContinueOnError)
+		o.addFlags(f)
+		if err := f.Parse(osArgs); err != nil {
+			t.Fatalf("could not parse the flags: %s", err)
+		}
+		return &o, f
+	}
+	cmd := &Cmd{Logger: mock_logger.New(t)}
+
+	t.Run("ProfileArgument", func(t *testing.T) {
+		o, f := newFlags(t, "--namespace=default")
+		args, err := cmd.applyProfile(f, configFileName, "", []string{"grafana-prod"})
+		if err != nil {
+			t.Fatalf("applyProfile error: %s", err)
+		}
+		if want := []string{"http://grafana.svc"}; !reflect.DeepEqual(args, want) {
+			t.Errorf("args wants %v but was %v", want, args)
+		}
+		if want := "prod"; *o.k8sOptions.Context != want {
+			t.Errorf("context wants %s but was %s", want, *o.k8sOptions.Context)
+		}
+		// the flag overrides the profile
+		if want := "default"; *o.k8sOptions.Namespace != want {
+			t.Errorf("namespace wants %s but was %s", want, *o.k8sOptions.Namespace)
+		}
+		if want := []string{"127.0.0.1:13000"}; !reflect.DeepEqual(o.addressCandidates, want) {
+			t.Errorf("addressCandidates wants %v but was %v", want, o.addressCandidates)
+		}
+		if want := "/dashboards"; o.openPath != want {
+			t.Errorf("openPath wants %s but was %s", want, o.openPath)
+		}
+		if !o.readOnly {
+			t.Errorf("readOnly wants true but was false")
+		}
+		if want := filepath.Join(dir, "policy.yaml"); o.policyFile != want {
+			t.Errorf("policyFile wants %s but was %s", want, o.policyFile)
+		}
+	})
+	t.Run("ProfileFlagWithURL", func(t *testing.T) {
+		_, f := newFlags(t)
+		args, err := cmd.applyProfile(f, configFileName, "grafana-prod", []string{"http://grafana.svc:3000"})
+		if err != nil {
+			t.Fatalf("applyProfile error: %s", err)
+		}
+		if want := []string{"http://grafana.svc:3000"}; !reflect.DeepEqual(args, want) {
+			t.Errorf("args wants %v but was %v", want, args)
+		}
+	})
+	t.Run("NoProfile", func(t *testing.T) {
+		o, f := newFlags(t)
+		args, err := cmd.applyProfile(f, configFileName, "", []string{"svc/headlamp"})
+		if err != nil {
+			t.Fatalf("applyProfile error: %s", err)
+		}
+		if want := []string{"svc/headlamp"}; !reflect.DeepEqual(args, want) {
+			t.Errorf("args wants %v but was %v", want, args)
+		}
+		if !reflect.DeepEqual(o.addressCandidates, defaultAddress) {
+			t.Errorf("addressCandidates wants %v but was %v", defaultAddress, o.addressCandidates)
+		}
+	})
+	t.Run("UnknownProfile", func(t *testing.T) {
+		_, f := newFlags(t)
+		if _, err := cmd.applyProfile(f, configFileName, "grafana-dev", nil); err == nil {
+			t.Errorf("applyProfile wants an error but was nil")
+		}
+	})
+}
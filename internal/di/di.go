@@ -8,8 +8,8 @@ import (
 	"github.com/google/wire"
 	"github.com/int128/kauthproxy/internal/authproxy"
 	"github.com/int128/kauthproxy/internal/browser"
+	"github.com/int128/kauthproxy/internal/certificate"
 	"github.com/int128/kauthproxy/internal/cmd"
-	"github.com/int128/kauthproxy/internal/env"
 	"github.com/int128/kauthproxy/internal/logger"
 	"github.com/int128/kauthproxy/internal/portforwarder"
 	"github.com/int128/kauthproxy/internal/resolver"
@@ -25,8 +25,8 @@ func NewCmd() cmd.Interface {
 		portforwarder.Set,
 		resolver.Set,
 		transport.Set,
-		env.Set,
 		browser.Set,
+		certificate.Set,
 		logger.Set,
 
 		// usecases
@@ -9,8 +9,8 @@ package di
 import (
 	"github.com/int128/kauthproxy/internal/authproxy"
 	"github.com/int128/kauthproxy/internal/browser"
+	"github.com/int128/kauthproxy/internal/certificate"
 	"github.com/int128/kauthproxy/internal/cmd"
-	"github.com/int128/kauthproxy/internal/env"
 	"github.com/int128/kauthproxy/internal/logger"
 	"github.com/int128/kauthproxy/internal/portforwarder"
 	"github.com/int128/kauthproxy/internal/resolver"
@@ -21,23 +21,31 @@ import (
 // Injectors from di.go:
 
 func NewCmd() cmd.Interface {
-	reverseProxy := &reverseproxy.ReverseProxy{}
-	portForwarder := &portforwarder.PortForwarder{}
 	loggerLogger := &logger.Logger{}
+	reverseProxy := &reverseproxy.ReverseProxy{
+		Logger: loggerLogger,
+	}
+	portForwarder := &portforwarder.PortForwarder{
+		Logger: loggerLogger,
+	}
 	factory := &resolver.Factory{
 		Logger: loggerLogger,
 	}
 	newFunc := _wireNewFuncValue
-	envEnv := &env.Env{}
+	newAPIServerFunc := _wireNewAPIServerFuncValue
 	browserBrowser := &browser.Browser{}
+	certificateCertificate := &certificate.Certificate{
+		Logger: loggerLogger,
+	}
 	authProxy := &authproxy.AuthProxy{
-		ReverseProxy:    reverseProxy,
-		PortForwarder:   portForwarder,
-		ResolverFactory: factory,
-		NewTransport:    newFunc,
-		Env:             envEnv,
-		Browser:         browserBrowser,
-		Logger:          loggerLogger,
+		ReverseProxy:          reverseProxy,
+		PortForwarder:         portForwarder,
+		ResolverFactory:       factory,
+		NewTransport:          newFunc,
+		NewAPIServerTransport: newAPIServerFunc,
+		Browser:               browserBrowser,
+		Certificate:           certificateCertificate,
+		Logger:                loggerLogger,
 	}
 	cmdCmd := &cmd.Cmd{
 		AuthProxy: authProxy,
@@ -47,5 +55,6 @@ func NewCmd() cmd.Interface {
 }
 
 var (
-	_wireNewFuncValue = transport.NewFunc(transport.New)
+	_wireNewFuncValue          = transport.NewFunc(transport.New)
+	_wireNewAPIServerFuncValue = transport.NewAPIServerFunc(transport.NewAPIServer)
 )
@@ -1,17 +1,19 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/int128/kauthproxy/internal/env (interfaces: Interface)
+// Source: github.com/int128/kauthproxy/internal/certificate (interfaces: Interface)
 //
 // Generated by this command:
 //
-//	mockgen -destination internal/mocks/mock_env/mock.go github.com/int128/kauthproxy/internal/env Interface
+//	mockgen -destination internal/mocks/mock_certificate/mock.go github.com/int128/kauthproxy/internal/certificate Interface
 //
 
-// Package mock_env is a generated GoMock package.
-package mock_env
+// Package mock_certificate is a generated GoMock package.
+package mock_certificate
 
 import (
+	tls "crypto/tls"
 	reflect "reflect"
 
+	certificate "github.com/int128/kauthproxy/internal/certificate"
 	gomock "go.uber.org/mock/gomock"
 )
 
@@ -39,17 +41,17 @@ func (m *MockInterface) EXPECT() *MockInterfaceMockRecorder {
 	return m.recorder
 }
 
-// AllocateLocalPort mocks base method.
-func (m *MockInterface) AllocateLocalPort() (int, error) {
+// Load mocks base method.
+func (m *MockInterface) Load(o certificate.Option) (*tls.Certificate, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AllocateLocalPort")
-	ret0, _ := ret[0].(int)
+	ret := m.ctrl.Call(m, "Load", o)
+	ret0, _ := ret[0].(*tls.Certificate)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// AllocateLocalPort indicates an expected call of AllocateLocalPort.
-func (mr *MockInterfaceMockRecorder) AllocateLocalPort() *gomock.Call {
+// Load indicates an expected call of Load.
+func (mr *MockInterfaceMockRecorder) Load(o any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AllocateLocalPort", reflect.TypeOf((*MockInterface)(nil).AllocateLocalPort))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Load", reflect.TypeOf((*MockInterface)(nil).Load), o)
 }
@@ -1,15 +1,17 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/int128/kauthproxy/internal/portforwarder (interfaces: Interface)
+// Source: github.com/int128/kauthproxy/internal/portforwarder (interfaces: Interface,Connection)
 //
 // Generated by this command:
 //
-//	mockgen -destination internal/mocks/mock_portforwarder/mock.go github.com/int128/kauthproxy/internal/portforwarder Interface
+//	mockgen -destination internal/mocks/mock_portforwarder/mock.go github.com/int128/kauthproxy/internal/portforwarder Interface,Connection
 //
 
 // Package mock_portforwarder is a generated GoMock package.
 package mock_portforwarder
 
 import (
+	context "context"
+	net "net"
 	reflect "reflect"
 
 	portforwarder "github.com/int128/kauthproxy/internal/portforwarder"
@@ -41,7 +43,7 @@ func (m *MockInterface) EXPECT() *MockInterfaceMockRecorder {
 }
 
 // Run mocks base method.
-func (m *MockInterface) Run(o portforwarder.Option, readyChan chan struct{}, stopChan <-chan struct{}) error {
+func (m *MockInterface) Run(o portforwarder.Option, readyChan chan<- portforwarder.Connection, stopChan <-chan struct{}) error {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Run", o, readyChan, stopChan)
 	ret0, _ := ret[0].(error)
@@ -53,3 +55,42 @@ func (mr *MockInterfaceMockRecorder) Run(o, readyChan, stopChan any) *gomock.Cal
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Run", reflect.TypeOf((*MockInterface)(nil).Run), o, readyChan, stopChan)
 }
+
+// MockConnection is a mock of Connection interface.
+type MockConnection struct {
+	ctrl     *gomock.Controller
+	recorder *MockConnectionMockRecorder
+	isgomock struct{}
+}
+
+// MockConnectionMockRecorder is the mock recorder for MockConnection.
+type MockConnectionMockRecorder struct {
+	mock *MockConnection
+}
+
+// NewMockConnection creates a new mock instance.
+func NewMockConnection(ctrl *gomock.Controller) *MockConnection {
+	mock := &MockConnection{ctrl: ctrl}
+	mock.recorder = &MockConnectionMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockConnection) EXPECT() *MockConnectionMockRecorder {
+	return m.recorder
+}
+
+// DialContext mocks base method.
+func (m *MockConnection) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DialContext", ctx, network, address)
+	ret0, _ := ret[0].(net.Conn)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DialContext indicates an expected call of DialContext.
+func (mr *MockConnectionMockRecorder) DialContext(ctx, network, address any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DialContext", reflect.TypeOf((*MockConnection)(nil).DialContext), ctx, network, address)
+}
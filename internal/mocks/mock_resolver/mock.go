@@ -12,6 +12,7 @@ package mock_resolver
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	resolver "github.com/int128/kauthproxy/internal/resolver"
 	gomock "go.uber.org/mock/gomock"
@@ -82,10 +83,56 @@ func (m *MockInterface) EXPECT() *MockInterfaceMockRecorder {
 	return m.recorder
 }
 
+// CreateServiceAccountToken mocks base method.
+func (m *MockInterface) CreateServiceAccountToken(ctx context.Context, namespace, serviceAccountName string, audiences []string, expiration time.Duration) (string, time.Time, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateServiceAccountToken", ctx, namespace, serviceAccountName, audiences, expiration)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(time.Time)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CreateServiceAccountToken indicates an expected call of CreateServiceAccountToken.
+func (mr *MockInterfaceMockRecorder) CreateServiceAccountToken(ctx, namespace, serviceAccountName, audiences, expiration any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateServiceAccountToken", reflect.TypeOf((*MockInterface)(nil).CreateServiceAccountToken), ctx, namespace, serviceAccountName, audiences, expiration)
+}
+
+// FindConfigMapData mocks base method.
+func (m *MockInterface) FindConfigMapData(ctx context.Context, namespace, configMapName, key string) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindConfigMapData", ctx, namespace, configMapName, key)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindConfigMapData indicates an expected call of FindConfigMapData.
+func (mr *MockInterfaceMockRecorder) FindConfigMapData(ctx, namespace, configMapName, key any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindConfigMapData", reflect.TypeOf((*MockInterface)(nil).FindConfigMapData), ctx, namespace, configMapName, key)
+}
+
+// FindEndpointsByServiceName mocks base method.
+func (m *MockInterface) FindEndpointsByServiceName(ctx context.Context, namespace, serviceName string, servicePort int) ([]resolver.Endpoint, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindEndpointsByServiceName", ctx, namespace, serviceName, servicePort)
+	ret0, _ := ret[0].([]resolver.Endpoint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindEndpointsByServiceName indicates an expected call of FindEndpointsByServiceName.
+func (mr *MockInterfaceMockRecorder) FindEndpointsByServiceName(ctx, namespace, serviceName, servicePort any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindEndpointsByServiceName", reflect.TypeOf((*MockInterface)(nil).FindEndpointsByServiceName), ctx, namespace, serviceName, servicePort)
+}
+
 // FindPodByName mocks base method.
-func (m *MockInterface) FindPodByName(ctx context.Context, namespace, podName string) (*v1.Pod, int, error) {
+func (m *MockInterface) FindPodByName(ctx context.Context, namespace, podName string, containerPort int) (*v1.Pod, int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindPodByName", ctx, namespace, podName)
+	ret := m.ctrl.Call(m, "FindPodByName", ctx, namespace, podName, containerPort)
 	ret0, _ := ret[0].(*v1.Pod)
 	ret1, _ := ret[1].(int)
 	ret2, _ := ret[2].(error)
@@ -93,15 +140,15 @@ func (m *MockInterface) FindPodByName(ctx context.Context, namespace, podName st
 }
 
 // FindPodByName indicates an expected call of FindPodByName.
-func (mr *MockInterfaceMockRecorder) FindPodByName(ctx, namespace, podName any) *gomock.Call {
+func (mr *MockInterfaceMockRecorder) FindPodByName(ctx, namespace, podName, containerPort any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindPodByName", reflect.TypeOf((*MockInterface)(nil).FindPodByName), ctx, namespace, podName)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindPodByName", reflect.TypeOf((*MockInterface)(nil).FindPodByName), ctx, namespace, podName, containerPort)
 }
 
 // FindPodByServiceName mocks base method.
-func (m *MockInterface) FindPodByServiceName(ctx context.Context, namespace, serviceName string) (*v1.Pod, int, error) {
+func (m *MockInterface) FindPodByServiceName(ctx context.Context, namespace, serviceName string, servicePort int) (*v1.Pod, int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindPodByServiceName", ctx, namespace, serviceName)
+	ret := m.ctrl.Call(m, "FindPodByServiceName", ctx, namespace, serviceName, servicePort)
 	ret0, _ := ret[0].(*v1.Pod)
 	ret1, _ := ret[1].(int)
 	ret2, _ := ret[2].(error)
@@ -109,7 +156,38 @@ func (m *MockInterface) FindPodByServiceName(ctx context.Context, namespace, ser
 }
 
 // FindPodByServiceName indicates an expected call of FindPodByServiceName.
-func (mr *MockInterfaceMockRecorder) FindPodByServiceName(ctx, namespace, serviceName any) *gomock.Call {
+func (mr *MockInterfaceMockRecorder) FindPodByServiceName(ctx, namespace, serviceName, servicePort any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindPodByServiceName", reflect.TypeOf((*MockInterface)(nil).FindPodByServiceName), ctx, namespace, serviceName, servicePort)
+}
+
+// FindPodByWorkloadName mocks base method.
+func (m *MockInterface) FindPodByWorkloadName(ctx context.Context, namespace string, kind resolver.WorkloadKind, workloadName string, containerPort int) (*v1.Pod, int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindPodByWorkloadName", ctx, namespace, kind, workloadName, containerPort)
+	ret0, _ := ret[0].(*v1.Pod)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// FindPodByWorkloadName indicates an expected call of FindPodByWorkloadName.
+func (mr *MockInterfaceMockRecorder) FindPodByWorkloadName(ctx, namespace, kind, workloadName, containerPort any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindPodByWorkloadName", reflect.TypeOf((*MockInterface)(nil).FindPodByWorkloadName), ctx, namespace, kind, workloadName, containerPort)
+}
+
+// FindSecretData mocks base method.
+func (m *MockInterface) FindSecretData(ctx context.Context, namespace, secretName, key string) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindSecretData", ctx, namespace, secretName, key)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindSecretData indicates an expected call of FindSecretData.
+func (mr *MockInterfaceMockRecorder) FindSecretData(ctx, namespace, secretName, key any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindPodByServiceName", reflect.TypeOf((*MockInterface)(nil).FindPodByServiceName), ctx, namespace, serviceName)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindSecretData", reflect.TypeOf((*MockInterface)(nil).FindSecretData), ctx, namespace, secretName, key)
 }
@@ -2,15 +2,24 @@
 package portforwarder
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/google/wire"
+	"github.com/int128/kauthproxy/internal/logger"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/transport/spdy"
+	streamhttp "k8s.io/streaming/pkg/httpstream"
 )
 
 var Set = wire.NewSet(
@@ -18,46 +27,209 @@ var Set = wire.NewSet(
 	wire.Bind(new(Interface), new(*PortForwarder)),
 )
 
+// Protocol represents a protocol of port forwarding.
+type Protocol string
+
+const (
+	// ProtocolAuto tries WebSocket first and falls back to SPDY, as well as kubectl.
+	ProtocolAuto      Protocol = "auto"
+	ProtocolWebSocket Protocol = "websocket"
+	ProtocolSPDY      Protocol = "spdy"
+)
+
 // Option represents an option of PortForwarder.
 type Option struct {
 	Config              *rest.Config
-	SourcePort          int
 	TargetNamespace     string
 	TargetPodName       string
 	TargetContainerPort int
+	// Protocol defaults to ProtocolAuto
+	Protocol Protocol
 }
 
 type Interface interface {
-	Run(o Option, readyChan chan struct{}, stopChan <-chan struct{}) error
+	Run(o Option, readyChan chan<- Connection, stopChan <-chan struct{}) error
+}
+
+// Connection represents a port forwarding connection to the pod.
+type Connection interface {
+	// DialContext opens a stream to the container port.
+	// The network and address are ignored.
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
 type PortForwarder struct {
+	Logger logger.Interface
 }
 
 // Run executes a port forwarder.
+// It does not listen on any local port.
+// Instead, the Connection opens a stream to the pod in-process.
 //
 // It returns nil if stopChan has been closed or connection has lost.
 // It returns an error if it could not connect to the pod.
 //
-// It will close the readyChan when the port forwarder is ready.
+// It will send the Connection to the readyChan when the port forwarder is ready.
 // Caller can stop the port forwarder by closing the stopChan.
-func (pf *PortForwarder) Run(o Option, readyChan chan struct{}, stopChan <-chan struct{}) error {
+func (pf *PortForwarder) Run(o Option, readyChan chan<- Connection, stopChan <-chan struct{}) error {
 	pfURL, err := url.Parse(fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/portforward", o.Config.Host, o.TargetNamespace, o.TargetPodName))
 	if err != nil {
 		return fmt.Errorf("could not build URL for portforward: %w", err)
 	}
+	streamConn, err := pf.dial(o, pfURL)
+	if err != nil {
+		return fmt.Errorf("could not connect to pod %s: %w", o.TargetPodName, err)
+	}
+	defer func() {
+		if err := streamConn.Close(); err != nil {
+			pf.Logger.V(1).Infof("could not close the connection: %s", err)
+		}
+	}()
+
+	if readyChan != nil {
+		readyChan <- &connection{logger: pf.Logger, streamConn: streamConn, port: o.TargetContainerPort}
+	}
+	select {
+	case <-stopChan:
+	case <-streamConn.CloseChan():
+	}
+	return nil
+}
+
+// dial connects to the pod using the protocol.
+// If the protocol is auto, it tries WebSocket first and falls back to SPDY
+// when the server or proxy does not support WebSocket.
+func (pf *PortForwarder) dial(o Option, pfURL *url.URL) (httpstream.Connection, error) {
+	switch o.Protocol {
+	case ProtocolSPDY:
+		return pf.dialSPDY(o, pfURL)
+	case ProtocolWebSocket:
+		return pf.dialWebSocket(o, pfURL)
+	}
+	streamConn, err := pf.dialWebSocket(o, pfURL)
+	if err == nil {
+		return streamConn, nil
+	}
+	// the WebSocket round tripper of client-go returns the errors of k8s.io/streaming
+	if !streamhttp.IsUpgradeFailure(err) && !streamhttp.IsHTTPSProxyError(err) {
+		return nil, err
+	}
+	pf.Logger.V(1).Infof("falling back to %s: %s", ProtocolSPDY, err)
+	return pf.dialSPDY(o, pfURL)
+}
+
+func (pf *PortForwarder) dialWebSocket(o Option, pfURL *url.URL) (httpstream.Connection, error) {
+	dialer, err := portforward.NewSPDYOverWebsocketDialer(pfURL, o.Config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create a websocket dialer: %w", err)
+	}
+	streamConn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return nil, err
+	}
+	pf.Logger.V(1).Infof("connected to pod %s using %s", o.TargetPodName, ProtocolWebSocket)
+	return streamConn, nil
+}
+
+func (pf *PortForwarder) dialSPDY(o Option, pfURL *url.URL) (httpstream.Connection, error) {
 	rt, upgrader, err := spdy.RoundTripperFor(o.Config)
 	if err != nil {
-		return fmt.Errorf("could not create a round tripper: %w", err)
+		return nil, fmt.Errorf("could not create a round tripper: %w", err)
 	}
 	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: rt}, http.MethodPost, pfURL)
-	portPair := fmt.Sprintf("%d:%d", o.SourcePort, o.TargetContainerPort)
-	forwarder, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, []string{portPair}, stopChan, readyChan, os.Stdout, os.Stderr)
+	streamConn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
 	if err != nil {
-		return fmt.Errorf("could not create a port forwarder: %w", err)
+		return nil, err
 	}
-	if err := forwarder.ForwardPorts(); err != nil {
-		return fmt.Errorf("could not run the port forwarder at %s: %w", portPair, err)
+	pf.Logger.V(1).Infof("connected to pod %s using %s", o.TargetPodName, ProtocolSPDY)
+	return streamConn, nil
+}
+
+type connection struct {
+	logger     logger.Interface
+	streamConn httpstream.Connection
+	port       int
+	requestID  atomic.Int64
+}
+
+// DialContext creates a pair of error and data streams, and returns a net.Conn bound to them.
+// This is an in-process equivalent of portforward.PortForwarder.handleConnection.
+func (c *connection) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return nil
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.Itoa(c.port))
+	headers.Set(corev1.PortForwardRequestIDHeader, strconv.FormatInt(c.requestID.Add(1), 10))
+	errorStream, err := c.streamConn.CreateStream(headers)
+	if err != nil {
+		return nil, fmt.Errorf("could not create an error stream for port %d: %w", c.port, err)
+	}
+	// we're not writing to this stream
+	_ = errorStream.Close()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := c.streamConn.CreateStream(headers)
+	if err != nil {
+		c.streamConn.RemoveStreams(errorStream)
+		return nil, fmt.Errorf("could not create a data stream for port %d: %w", c.port, err)
+	}
+
+	local, remote := net.Pipe()
+	go c.forward(remote, errorStream, dataStream)
+	return local, nil
+}
+
+// forward copies between the pipe and data stream until either side is closed.
+func (c *connection) forward(pipe net.Conn, errorStream, dataStream httpstream.Stream) {
+	defer c.streamConn.RemoveStreams(errorStream, dataStream)
+	defer func() { _ = pipe.Close() }()
+
+	errorChan := make(chan error, 1)
+	go func() {
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			errorChan <- fmt.Errorf("could not read the error stream for port %d: %w", c.port, err)
+		case len(message) > 0:
+			errorChan <- fmt.Errorf("an error occurred forwarding to port %d: %s", c.port, message)
+		}
+		close(errorChan)
+	}()
+
+	remoteDone := make(chan struct{})
+	go func() {
+		defer close(remoteDone)
+		// copy from the remote side to the pipe
+		if _, err := io.Copy(pipe, dataStream); err != nil && !isClosedError(err) {
+			c.logger.V(1).Infof("could not copy from the data stream: %s", err)
+		}
+	}()
+	localDone := make(chan struct{})
+	go func() {
+		defer close(localDone)
+		// inform the server we're not sending any more data after copy unblocks
+		defer func() { _ = dataStream.Close() }()
+		// copy from the pipe to the remote side
+		if _, err := io.Copy(dataStream, pipe); err != nil && !isClosedError(err) {
+			c.logger.V(1).Infof("could not copy to the data stream: %s", err)
+		}
+	}()
+
+	select {
+	case <-remoteDone:
+	case <-localDone:
+	}
+	// reset the data stream to discard any unsent data before waiting for the error stream
+	_ = dataStream.Reset()
+	if err := <-errorChan; err != nil {
+		// the same as kubectl, close the connection so that the caller can reconnect
+		c.logger.Printf("port forwarder: %s", err)
+		_ = c.streamConn.Close()
+	}
+}
+
+func isClosedError(err error) bool {
+	return errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
 }
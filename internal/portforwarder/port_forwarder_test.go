@@ -0,0 +1,343 @@
+package portforwarder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/int128/kauthproxy/internal/logger/mock_logger"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	streamhttp "k8s.io/streaming/pkg/httpstream"
+)
+
+// fakeStream is a stream connected to the pod side by the pipes.
+type fakeStream struct {
+	headers http.Header
+	// reader receives the data written by the pod
+	reader *io.PipeReader
+	// writer sends the data to the pod
+	writer *io.PipeWriter
+	// podReader and podWriter are the pod side
+	podReader *io.PipeReader
+	podWriter *io.PipeWriter
+}
+
+func newFakeStream(headers http.Header) *fakeStream {
+	reader, podWriter := io.Pipe()
+	podReader, writer := io.Pipe()
+	return &fakeStream{
+		headers:   headers.Clone(),
+		reader:    reader,
+		writer:    writer,
+		podReader: podReader,
+		podWriter: podWriter,
+	}
+}
+
+func (s *fakeStream) Read(p []byte) (int, error)  { return s.reader.Read(p) }
+func (s *fakeStream) Write(p []byte) (int, error) { return s.writer.Write(p) }
+
+// Close closes only the direction to the pod.
+func (s *fakeStream) Close() error { return s.writer.Close() }
+
+func (s *fakeStream) Reset() error {
+	_ = s.reader.CloseWithError(io.ErrClosedPipe)
+	return s.writer.Close()
+}
+
+func (s *fakeStream) Headers() http.Header { return s.headers }
+func (s *fakeStream) Identifier() uint32   { return 0 }
+
+// fakeConnection records the streams.
+type fakeConnection struct {
+	createErr error
+	removed   chan []httpstream.Stream
+	closeChan chan bool
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	streams []*fakeStream
+}
+
+func newFakeConnection() *fakeConnection {
+	return &fakeConnection{
+		removed:   make(chan []httpstream.Stream, 1),
+		closeChan: make(chan bool),
+	}
+}
+
+func (c *fakeConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	if c.createErr != nil {
+		return nil, c.createErr
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := newFakeStream(headers)
+	c.streams = append(c.streams, s)
+	return s, nil
+}
+
+func (c *fakeConnection) Close() error {
+	c.closeOnce.Do(func() { close(c.closeChan) })
+	return nil
+}
+
+func (c *fakeConnection) CloseChan() <-chan bool               { return c.closeChan }
+func (c *fakeConnection) SetIdleTimeout(timeout time.Duration) {}
+func (c *fakeConnection) RemoveStreams(streams ...httpstream.Stream) {
+	c.removed <- streams
+}
+
+func (c *fakeConnection) stream(t *testing.T, i int) *fakeStream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.streams) <= i {
+		t.Fatalf("stream %d wants to exist but was %d stream(s)", i, len(c.streams))
+	}
+	return c.streams[i]
+}
+
+func (c *fakeConnection) closed() bool {
+	select {
+	case <-c.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func waitRemoved(t *testing.T, c *fakeConnection) []httpstream.Stream {
+	select {
+	case streams := <-c.removed:
+		return streams
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for RemoveStreams")
+		return nil
+	}
+}
+
+func TestConnection_DialContext(t *testing.T) {
+	t.Run("Forward", func(t *testing.T) {
+		streamConn := newFakeConnection()
+		c := &connection{logger: mock_logger.New(t), streamConn: streamConn, port: 4466}
+		conn, err := c.DialContext(context.TODO(), "tcp", "localhost:4466")
+		if err != nil {
+			t.Fatalf("DialContext error: %s", err)
+		}
+		errorStream, dataStream := streamConn.stream(t, 0), streamConn.stream(t, 1)
+		for _, s := range []struct {
+			stream   *fakeStream
+			wantType string
+		}{
+			{errorStream, corev1.StreamTypeError},
+			{dataStream, corev1.StreamTypeData},
+		} {
+			if got := s.stream.headers.Get(corev1.StreamType); got != s.wantType {
+				t.Errorf("StreamType wants %s but was %s", s.wantType, got)
+			}
+			if got := s.stream.headers.Get(corev1.PortHeader); got != "4466" {
+				t.Errorf("Port wants 4466 but was %s", got)
+			}
+			if got := s.stream.headers.Get(corev1.PortForwardRequestIDHeader); got != "1" {
+				t.Errorf("RequestID wants 1 but was %s", got)
+			}
+		}
+
+		go func() { _, _ = conn.Write([]byte("ping")) }()
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(dataStream.podReader, b); err != nil {
+			t.Fatalf("could not read from the data stream: %s", err)
+		}
+		if string(b) != "ping" {
+			t.Errorf("data stream wants ping but was %s", b)
+		}
+		go func() { _, _ = dataStream.podWriter.Write([]byte("pong")) }()
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("could not read from the connection: %s", err)
+		}
+		if string(b) != "pong" {
+			t.Errorf("connection wants pong but was %s", b)
+		}
+
+		if err := conn.Close(); err != nil {
+			t.Errorf("Close error: %s", err)
+		}
+		// the pod closes the error stream without any error
+		_ = errorStream.podWriter.Close()
+		if removed := waitRemoved(t, streamConn); len(removed) != 2 {
+			t.Errorf("RemoveStreams wants 2 streams but was %d", len(removed))
+		}
+		if streamConn.closed() {
+			t.Errorf("connection wants open but was closed")
+		}
+
+		// the next stream has a new request ID
+		if _, err := c.DialContext(context.TODO(), "tcp", "localhost:4466"); err != nil {
+			t.Fatalf("DialContext error: %s", err)
+		}
+		if got := streamConn.stream(t, 3).headers.Get(corev1.PortForwardRequestIDHeader); got != "2" {
+			t.Errorf("RequestID wants 2 but was %s", got)
+		}
+	})
+
+	t.Run("ErrorStream", func(t *testing.T) {
+		streamConn := newFakeConnection()
+		c := &connection{logger: mock_logger.New(t), streamConn: streamConn, port: 4466}
+		conn, err := c.DialContext(context.TODO(), "tcp", "localhost:4466")
+		if err != nil {
+			t.Fatalf("DialContext error: %s", err)
+		}
+		defer conn.Close()
+		errorStream, dataStream := streamConn.stream(t, 0), streamConn.stream(t, 1)
+		go func() {
+			_, _ = errorStream.podWriter.Write([]byte("connection refused"))
+			_ = errorStream.podWriter.Close()
+			_ = dataStream.podWriter.Close()
+		}()
+		waitRemoved(t, streamConn)
+		// the connection is closed so that the caller reconnects
+		if !streamConn.closed() {
+			t.Errorf("connection wants closed but was open")
+		}
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("Read wants an error but was nil")
+		}
+	})
+
+	t.Run("ContextCanceled", func(t *testing.T) {
+		streamConn := newFakeConnection()
+		c := &connection{logger: mock_logger.New(t), streamConn: streamConn, port: 4466}
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+		if _, err := c.DialContext(ctx, "tcp", "localhost:4466"); !errors.Is(err, context.Canceled) {
+			t.Errorf("err wants context.Canceled but was %v", err)
+		}
+		if len(streamConn.streams) != 0 {
+			t.Errorf("streams wants empty but was %d stream(s)", len(streamConn.streams))
+		}
+	})
+
+	t.Run("CreateStreamError", func(t *testing.T) {
+		streamConn := newFakeConnection()
+		streamConn.createErr = errors.New("connection closed")
+		c := &connection{logger: mock_logger.New(t), streamConn: streamConn, port: 4466}
+		if _, err := c.DialContext(context.TODO(), "tcp", "localhost:4466"); err == nil {
+			t.Errorf("DialContext wants an error but was nil")
+		}
+	})
+}
+
+// newPortForwardServer returns a server which rejects a WebSocket upgrade and accepts SPDY.
+// It sends the methods of requests to the channel.
+func newPortForwardServer(t *testing.T, methods chan<- string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods <- r.Method
+		if r.URL.Path != "/api/v1/namespaces/NAMESPACE/pods/POD/portforward" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			// the same as a server or proxy which does not support WebSocket
+			http.Error(w, "upgrade is not supported", http.StatusBadRequest)
+			return
+		}
+		if _, err := httpstream.Handshake(r, w, []string{portforward.PortForwardProtocolV1Name}); err != nil {
+			t.Errorf("handshake error: %s", err)
+			return
+		}
+		conn := spdy.NewResponseUpgrader().UpgradeResponse(w, r, func(httpstream.Stream, <-chan struct{}) error { return nil })
+		if conn == nil {
+			t.Errorf("could not upgrade the connection")
+			return
+		}
+		// wait until the client closes the connection
+		<-conn.CloseChan()
+		close(methods)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestPortForwarder_Run(t *testing.T) {
+	run := func(t *testing.T, protocol Protocol) ([]string, error) {
+		methods := make(chan string, 10)
+		s := newPortForwardServer(t, methods)
+		pf := &PortForwarder{Logger: mock_logger.New(t)}
+		o := Option{
+			Config:              &rest.Config{Host: s.URL},
+			TargetNamespace:     "NAMESPACE",
+			TargetPodName:       "POD",
+			TargetContainerPort: 4466,
+			Protocol:            protocol,
+		}
+		readyChan := make(chan Connection, 1)
+		stopChan := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- pf.Run(o, readyChan, stopChan)
+		}()
+		select {
+		case <-readyChan:
+			close(stopChan)
+			if err := <-done; err != nil {
+				return nil, err
+			}
+		case err := <-done:
+			if err == nil {
+				t.Fatalf("Run wants an error but was nil")
+			}
+			close(methods)
+			return slices.Collect(chanValues(methods)), err
+		}
+		// the server closes the channel when the client has closed the connection
+		return slices.Collect(chanValues(methods)), nil
+	}
+
+	t.Run("FallbackToSPDY", func(t *testing.T) {
+		methods, err := run(t, ProtocolAuto)
+		if err != nil {
+			t.Fatalf("Run error: %s", err)
+		}
+		if want := []string{http.MethodGet, http.MethodPost}; !slices.Equal(methods, want) {
+			t.Errorf("methods wants %v but was %v", want, methods)
+		}
+	})
+	t.Run("SPDY", func(t *testing.T) {
+		methods, err := run(t, ProtocolSPDY)
+		if err != nil {
+			t.Fatalf("Run error: %s", err)
+		}
+		if want := []string{http.MethodPost}; !slices.Equal(methods, want) {
+			t.Errorf("methods wants %v but was %v", want, methods)
+		}
+	})
+	t.Run("WebSocket", func(t *testing.T) {
+		methods, err := run(t, ProtocolWebSocket)
+		if !streamhttp.IsUpgradeFailure(err) {
+			t.Errorf("err wants an upgrade failure but was %v", err)
+		}
+		if want := []string{http.MethodGet}; !slices.Equal(methods, want) {
+			t.Errorf("methods wants %v but was %v", want, methods)
+		}
+	})
+}
+
+func chanValues[T any](c <-chan T) func(yield func(T) bool) {
+	return func(yield func(T) bool) {
+		for v := range c {
+			if !yield(v) {
+				return
+			}
+		}
+	}
+}
@@ -3,15 +3,23 @@ package resolver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/google/wire"
 	"github.com/int128/kauthproxy/internal/logger"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
+	typedappsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	typeddiscoveryv1 "k8s.io/client-go/kubernetes/typed/discovery/v1"
 	"k8s.io/client-go/rest"
 )
 
@@ -36,28 +44,78 @@ func (f *Factory) New(config *rest.Config) (Interface, error) {
 		return nil, fmt.Errorf("could not create a client: %w", err)
 	}
 	return &Resolver{
-		Logger: f.Logger,
-		CoreV1: clientset.CoreV1(),
+		Logger:      f.Logger,
+		CoreV1:      clientset.CoreV1(),
+		AppsV1:      clientset.AppsV1(),
+		DiscoveryV1: clientset.DiscoveryV1(),
 	}, nil
 }
 
+// WorkloadKind represents a kind of workload resource.
+type WorkloadKind string
+
+const (
+	WorkloadKindDeployment  WorkloadKind = "Deployment"
+	WorkloadKindStatefulSet WorkloadKind = "StatefulSet"
+	WorkloadKindDaemonSet   WorkloadKind = "DaemonSet"
+)
+
+// Endpoint represents a pod and container port.
+type Endpoint struct {
+	Pod           *corev1.Pod
+	ContainerPort int
+}
+
 type Interface interface {
-	FindPodByServiceName(ctx context.Context, namespace, serviceName string) (*corev1.Pod, int, error)
-	FindPodByName(ctx context.Context, namespace, podName string) (*corev1.Pod, int, error)
+	FindEndpointsByServiceName(ctx context.Context, namespace, serviceName string, servicePort int) ([]Endpoint, error)
+	FindPodByServiceName(ctx context.Context, namespace, serviceName string, servicePort int) (*corev1.Pod, int, error)
+	FindPodByWorkloadName(ctx context.Context, namespace string, kind WorkloadKind, workloadName string, containerPort int) (*corev1.Pod, int, error)
+	FindPodByName(ctx context.Context, namespace, podName string, containerPort int) (*corev1.Pod, int, error)
+	FindSecretData(ctx context.Context, namespace, secretName, key string) ([]byte, error)
+	FindConfigMapData(ctx context.Context, namespace, configMapName, key string) ([]byte, error)
+	CreateServiceAccountToken(ctx context.Context, namespace, serviceAccountName string, audiences []string, expiration time.Duration) (string, time.Time, error)
 }
 
 // Resolver provides resolving a pod and container port.
 type Resolver struct {
-	Logger logger.Interface
-	CoreV1 typedcorev1.CoreV1Interface
+	Logger      logger.Interface
+	CoreV1      typedcorev1.CoreV1Interface
+	AppsV1      typedappsv1.AppsV1Interface
+	DiscoveryV1 typeddiscoveryv1.DiscoveryV1Interface
 }
 
 // FindPodByServiceName returns a pod and container port associated with the service.
-func (r *Resolver) FindPodByServiceName(ctx context.Context, namespace, serviceName string) (*corev1.Pod, int, error) {
+// If servicePort is 0, the service must have exactly one port.
+// The service port is mapped to the container port via the targetPort.
+//
+// It returns a ready pod, preferring the ready endpoints of the service.
+// It returns an error with the reasons if no pod is ready.
+func (r *Resolver) FindPodByServiceName(ctx context.Context, namespace, serviceName string, servicePort int) (*corev1.Pod, int, error) {
+	endpoints, err := r.FindEndpointsByServiceName(ctx, namespace, serviceName, servicePort)
+	if err != nil {
+		return nil, 0, err
+	}
+	endpoint := endpoints[0]
+	r.Logger.V(1).Infof("chose container port %d of pod %s", endpoint.ContainerPort, endpoint.Pod.Name)
+	return endpoint.Pod, endpoint.ContainerPort, nil
+}
+
+// FindEndpointsByServiceName returns all ready pods and container ports associated with the service,
+// in order of preference.
+// See FindPodByServiceName for details.
+func (r *Resolver) FindEndpointsByServiceName(ctx context.Context, namespace, serviceName string, servicePort int) ([]Endpoint, error) {
 	r.Logger.V(1).Infof("finding service %s in namespace %s", serviceName, namespace)
 	service, err := r.CoreV1.Services(namespace).Get(ctx, serviceName, metav1.GetOptions{})
 	if err != nil {
-		return nil, 0, fmt.Errorf("could not find the service: %w", err)
+		return nil, fmt.Errorf("could not find the service: %w", err)
+	}
+	port, err := findServicePort(service, servicePort)
+	if err != nil {
+		return nil, err
+	}
+	r.Logger.V(1).Infof("found service port %d (target port %s) of service %s", port.Port, port.TargetPort.String(), service.Name)
+	if len(service.Spec.Selector) == 0 {
+		return nil, fmt.Errorf("service %s has no selector", service.Name)
 	}
 	var selectors []string
 	for k, v := range service.Spec.Selector {
@@ -67,37 +125,317 @@ func (r *Resolver) FindPodByServiceName(ctx context.Context, namespace, serviceN
 	r.Logger.V(1).Infof("finding pods by selector %s", selectors)
 	pods, err := r.CoreV1.Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
 	if err != nil {
-		return nil, 0, fmt.Errorf("could not find pods by selector %s: %w", selector, err)
+		return nil, fmt.Errorf("could not find pods by selector %s: %w", selector, err)
 	}
 	r.Logger.V(1).Infof("found %d pod(s)", len(pods.Items))
 	if len(pods.Items) == 0 {
-		return nil, 0, fmt.Errorf("no pod matched to selector %s", selector)
+		return nil, fmt.Errorf("no pod matched to selector %s", selector)
 	}
-	pod := &pods.Items[0]
-	r.Logger.V(1).Infof("first matched pod %s", pod.Name)
-	for _, container := range pod.Spec.Containers {
-		for _, port := range container.Ports {
-			r.Logger.V(1).Infof("found container port %d in container %s of pod %s",
-				port.ContainerPort, container.Name, pod.Name)
-			return pod, int(port.ContainerPort), nil
+	readyEndpoints := r.findReadyEndpoints(ctx, namespace, serviceName)
+	readyPods, err := rankPods(pods.Items, readyEndpoints)
+	if err != nil {
+		return nil, fmt.Errorf("no ready pod of service %s: %w", service.Name, err)
+	}
+	r.Logger.V(1).Infof("found %d ready pod(s)", len(readyPods))
+	var endpoints []Endpoint
+	for _, pod := range readyPods {
+		containerPort, err := findTargetPort(pod, port)
+		if err != nil {
+			return nil, err
 		}
+		endpoints = append(endpoints, Endpoint{Pod: pod, ContainerPort: containerPort})
 	}
-	return nil, 0, fmt.Errorf("no container port in pod %s", pod.Name)
+	return endpoints, nil
 }
 
 // FindPodByName finds a pod and container port by name.
-func (r *Resolver) FindPodByName(ctx context.Context, namespace, podName string) (*corev1.Pod, int, error) {
+// If containerPort is 0, it returns the first container port of the pod.
+func (r *Resolver) FindPodByName(ctx context.Context, namespace, podName string, containerPort int) (*corev1.Pod, int, error) {
 	r.Logger.V(1).Infof("finding pod %s in namespace %s", podName, namespace)
 	pod, err := r.CoreV1.Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
 	if err != nil {
 		return nil, 0, fmt.Errorf("could not find the pod: %w", err)
 	}
-	for _, container := range pod.Spec.Containers {
-		for _, port := range container.Ports {
-			r.Logger.V(1).Infof("found container port %d in container %s of pod %s",
-				port.ContainerPort, container.Name, pod.Name)
-			return pod, int(port.ContainerPort), nil
+	port, err := r.findContainerPort(pod, containerPort)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.Logger.V(1).Infof("found container port %d of pod %s", port, pod.Name)
+	return pod, port, nil
+}
+
+// FindPodByWorkloadName returns a ready pod and container port of the workload,
+// such as a deployment, statefulset or daemonset.
+// If containerPort is 0, it returns the first container port of the pod.
+func (r *Resolver) FindPodByWorkloadName(ctx context.Context, namespace string, kind WorkloadKind, workloadName string, containerPort int) (*corev1.Pod, int, error) {
+	r.Logger.V(1).Infof("finding %s %s in namespace %s", kind, workloadName, namespace)
+	labelSelector, err := r.getWorkloadSelector(ctx, namespace, kind, workloadName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not find the %s: %w", kind, err)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid selector of %s %s: %w", kind, workloadName, err)
+	}
+	r.Logger.V(1).Infof("finding pods by selector %s", selector)
+	pods, err := r.CoreV1.Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not find pods by selector %s: %w", selector, err)
+	}
+	r.Logger.V(1).Infof("found %d pod(s)", len(pods.Items))
+	if len(pods.Items) == 0 {
+		return nil, 0, fmt.Errorf("no pod matched to selector %s", selector)
+	}
+	readyPods, err := rankPods(pods.Items, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("no ready pod of %s %s: %w", kind, workloadName, err)
+	}
+	pod := readyPods[0]
+	r.Logger.V(1).Infof("found %d ready pod(s), chose pod %s", len(readyPods), pod.Name)
+	port, err := r.findContainerPort(pod, containerPort)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.Logger.V(1).Infof("found container port %d of pod %s", port, pod.Name)
+	return pod, port, nil
+}
+
+// FindSecretData returns the value of the key in the secret, such as a CA certificate.
+func (r *Resolver) FindSecretData(ctx context.Context, namespace, secretName, key string) ([]byte, error) {
+	r.Logger.V(1).Infof("finding key %s of secret %s in namespace %s", key, secretName, namespace)
+	secret, err := r.CoreV1.Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not find the secret: %w", err)
+	}
+	data, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no key %s", secretName, key)
+	}
+	return data, nil
+}
+
+// FindConfigMapData returns the value of the key in the config map, such as a CA certificate.
+func (r *Resolver) FindConfigMapData(ctx context.Context, namespace, configMapName, key string) ([]byte, error) {
+	r.Logger.V(1).Infof("finding key %s of configmap %s in namespace %s", key, configMapName, namespace)
+	configMap, err := r.CoreV1.ConfigMaps(namespace).Get(ctx, configMapName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not find the configmap: %w", err)
+	}
+	data, ok := configMap.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s has no key %s", configMapName, key)
+	}
+	return []byte(data), nil
+}
+
+// CreateServiceAccountToken creates a token of the service account by the TokenRequest API.
+// It returns the token and expiry.
+func (r *Resolver) CreateServiceAccountToken(ctx context.Context, namespace, serviceAccountName string, audiences []string, expiration time.Duration) (string, time.Time, error) {
+	r.Logger.V(1).Infof("creating a token of service account %s in namespace %s", serviceAccountName, namespace)
+	tr := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{Audiences: audiences},
+	}
+	if expiration > 0 {
+		expirationSeconds := int64(expiration.Seconds())
+		tr.Spec.ExpirationSeconds = &expirationSeconds
+	}
+	created, err := r.CoreV1.ServiceAccounts(namespace).CreateToken(ctx, serviceAccountName, tr, metav1.CreateOptions{})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("could not create a token of the service account: %w", err)
+	}
+	r.Logger.V(1).Infof("created a token of service account %s, expires at %s", serviceAccountName, created.Status.ExpirationTimestamp)
+	return created.Status.Token, created.Status.ExpirationTimestamp.Time, nil
+}
+
+func (r *Resolver) getWorkloadSelector(ctx context.Context, namespace string, kind WorkloadKind, name string) (*metav1.LabelSelector, error) {
+	switch kind {
+	case WorkloadKindDeployment:
+		deployment, err := r.AppsV1.Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return deployment.Spec.Selector, nil
+	case WorkloadKindStatefulSet:
+		statefulSet, err := r.AppsV1.StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return statefulSet.Spec.Selector, nil
+	case WorkloadKindDaemonSet:
+		daemonSet, err := r.AppsV1.DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return daemonSet.Spec.Selector, nil
+	}
+	return nil, fmt.Errorf("unknown kind %s", kind)
+}
+
+// findReadyEndpoints returns the names of pods which are ready in the EndpointSlices of the service.
+// It returns nil if the EndpointSlices are not available, e.g. no permission.
+func (r *Resolver) findReadyEndpoints(ctx context.Context, namespace, serviceName string) map[string]bool {
+	selector := fmt.Sprintf("%s=%s", discoveryv1.LabelServiceName, serviceName)
+	endpointSlices, err := r.DiscoveryV1.EndpointSlices(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		r.Logger.V(1).Infof("could not list the endpoint slices, fallback to the pod status: %s", err)
+		return nil
+	}
+	endpoints := make(map[string]bool)
+	for _, endpointSlice := range endpointSlices.Items {
+		for _, endpoint := range endpointSlice.Endpoints {
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" {
+				continue
+			}
+			// nil should be interpreted as ready
+			ready := endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+			endpoints[endpoint.TargetRef.Name] = endpoints[endpoint.TargetRef.Name] || ready
+		}
+	}
+	r.Logger.V(1).Infof("found %d endpoint(s) of service %s", len(endpoints), serviceName)
+	if len(endpoints) == 0 {
+		return nil
+	}
+	return endpoints
+}
+
+// rankPods returns the ready pods in order of preference.
+// A pod is ready if it is running, not terminating and has the Ready condition.
+// If endpoints is given, a pod must be ready in the endpoints as well.
+// It returns an error with the reasons if no pod is ready.
+func rankPods(pods []corev1.Pod, endpoints map[string]bool) ([]*corev1.Pod, error) {
+	var readyPods []*corev1.Pod
+	var reasons []string
+	for i := range pods {
+		pod := &pods[i]
+		if reason := podNotReadyReason(pod, endpoints); reason != "" {
+			reasons = append(reasons, fmt.Sprintf("pod %s is %s", pod.Name, reason))
+			continue
+		}
+		readyPods = append(readyPods, pod)
+	}
+	if len(readyPods) == 0 {
+		return nil, errors.New(strings.Join(reasons, ", "))
+	}
+	// prefer the newer pod, which is likely to survive a rollout
+	sort.SliceStable(readyPods, func(i, j int) bool {
+		return readyPods[j].CreationTimestamp.Before(&readyPods[i].CreationTimestamp)
+	})
+	return readyPods, nil
+}
+
+func podNotReadyReason(pod *corev1.Pod, endpoints map[string]bool) string {
+	if pod.DeletionTimestamp != nil {
+		return "terminating"
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return fmt.Sprintf("in phase %s", pod.Status.Phase)
+	}
+	if !isPodReady(pod) {
+		return "not ready"
+	}
+	if endpoints != nil && !endpoints[pod.Name] {
+		return "not ready in the endpoints"
+	}
+	return ""
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// findServicePort returns the service port.
+// If port is 0, it returns the port only if the service has exactly one port.
+func findServicePort(service *corev1.Service, port int) (*corev1.ServicePort, error) {
+	if port != 0 {
+		for i := range service.Spec.Ports {
+			if int(service.Spec.Ports[i].Port) == port {
+				return &service.Spec.Ports[i], nil
+			}
+		}
+		return nil, fmt.Errorf("service %s has no port %d (available: %s)",
+			service.Name, port, formatServicePorts(service.Spec.Ports))
+	}
+	switch len(service.Spec.Ports) {
+	case 0:
+		return nil, fmt.Errorf("no port in service %s", service.Name)
+	case 1:
+		return &service.Spec.Ports[0], nil
+	}
+	return nil, fmt.Errorf("service %s has multiple ports, specify the port in the URL (available: %s)",
+		service.Name, formatServicePorts(service.Spec.Ports))
+}
+
+// findContainerPort returns the container port of the pod.
+// If port is 0, it returns the first container port.
+func (r *Resolver) findContainerPort(pod *corev1.Pod, port int) (int, error) {
+	if port != 0 {
+		return port, nil
+	}
+	ports := containerPorts(pod)
+	if len(ports) == 0 {
+		return 0, fmt.Errorf("no container port in pod %s", pod.Name)
+	}
+	if len(ports) > 1 {
+		r.Logger.Printf("Using the first container port %d of pod %s, specify the port in the URL to use another (available: %s)",
+			ports[0].ContainerPort, pod.Name, formatContainerPorts(ports))
+	}
+	return int(ports[0].ContainerPort), nil
+}
+
+// findTargetPort returns the container port corresponding to the target port of the service port.
+func findTargetPort(pod *corev1.Pod, port *corev1.ServicePort) (int, error) {
+	switch {
+	case port.TargetPort.Type == intstr.String:
+		ports := containerPorts(pod)
+		for _, p := range ports {
+			if p.Name == port.TargetPort.StrVal {
+				return int(p.ContainerPort), nil
+			}
 		}
+		return 0, fmt.Errorf("pod %s has no container port named %s (available: %s)",
+			pod.Name, port.TargetPort.StrVal, formatContainerPorts(ports))
+	case port.TargetPort.IntVal != 0:
+		return int(port.TargetPort.IntVal), nil
+	}
+	// targetPort defaults to the service port
+	return int(port.Port), nil
+}
+
+func containerPorts(pod *corev1.Pod) []corev1.ContainerPort {
+	var ports []corev1.ContainerPort
+	for _, container := range pod.Spec.Containers {
+		ports = append(ports, container.Ports...)
+	}
+	return ports
+}
+
+func formatServicePorts(ports []corev1.ServicePort) string {
+	var s []string
+	for _, p := range ports {
+		s = append(s, formatPort(p.Name, p.Port))
+	}
+	return strings.Join(s, ", ")
+}
+
+func formatContainerPorts(ports []corev1.ContainerPort) string {
+	var s []string
+	for _, p := range ports {
+		s = append(s, formatPort(p.Name, p.ContainerPort))
+	}
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, ", ")
+}
+
+func formatPort(name string, port int32) string {
+	if name == "" {
+		return fmt.Sprintf("%d", port)
 	}
-	return nil, 0, fmt.Errorf("no container port in pod %s", pod.Name)
+	return fmt.Sprintf("%d/%s", port, name)
 }
@@ -0,0 +1,311 @@
+package resolver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/int128/kauthproxy/internal/logger/mock_logger"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResolver_FindPodByServiceName(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "headlamp-12345678-12345678",
+			Namespace: "kube-system",
+			Labels:    map[string]string{"app": "headlamp"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "metrics",
+					Ports: []corev1.ContainerPort{{Name: "metrics", ContainerPort: 9090}},
+				},
+				{
+					Name:  "headlamp",
+					Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 4466}},
+				},
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	newService := func(ports ...corev1.ServicePort) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "headlamp", Namespace: "kube-system"},
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{"app": "headlamp"},
+				Ports:    ports,
+			},
+		}
+	}
+	newResolver := func(t *testing.T, service *corev1.Service) *Resolver {
+		clientset := fake.NewClientset(service, pod)
+		return &Resolver{Logger: mock_logger.New(t), CoreV1: clientset.CoreV1(), DiscoveryV1: clientset.DiscoveryV1()}
+	}
+
+	t.Run("NamedTargetPort", func(t *testing.T) {
+		r := newResolver(t, newService(corev1.ServicePort{Port: 80, TargetPort: intstr.FromString("http")}))
+		gotPod, gotPort, err := r.FindPodByServiceName(context.TODO(), "kube-system", "headlamp", 0)
+		if err != nil {
+			t.Fatalf("FindPodByServiceName error: %s", err)
+		}
+		if gotPod.Name != pod.Name {
+			t.Errorf("pod name wants %s but was %s", pod.Name, gotPod.Name)
+		}
+		if gotPort != 4466 {
+			t.Errorf("port wants 4466 but was %d", gotPort)
+		}
+	})
+	t.Run("NumericTargetPort", func(t *testing.T) {
+		r := newResolver(t, newService(
+			corev1.ServicePort{Name: "metrics", Port: 9090, TargetPort: intstr.FromInt32(9090)},
+			corev1.ServicePort{Name: "http", Port: 8080, TargetPort: intstr.FromInt32(4466)},
+		))
+		_, gotPort, err := r.FindPodByServiceName(context.TODO(), "kube-system", "headlamp", 8080)
+		if err != nil {
+			t.Fatalf("FindPodByServiceName error: %s", err)
+		}
+		if gotPort != 4466 {
+			t.Errorf("port wants 4466 but was %d", gotPort)
+		}
+	})
+	t.Run("DefaultTargetPort", func(t *testing.T) {
+		r := newResolver(t, newService(corev1.ServicePort{Port: 4466}))
+		_, gotPort, err := r.FindPodByServiceName(context.TODO(), "kube-system", "headlamp", 0)
+		if err != nil {
+			t.Fatalf("FindPodByServiceName error: %s", err)
+		}
+		if gotPort != 4466 {
+			t.Errorf("port wants 4466 but was %d", gotPort)
+		}
+	})
+	t.Run("AmbiguousPort", func(t *testing.T) {
+		r := newResolver(t, newService(
+			corev1.ServicePort{Name: "metrics", Port: 9090},
+			corev1.ServicePort{Name: "http", Port: 8080},
+		))
+		_, _, err := r.FindPodByServiceName(context.TODO(), "kube-system", "headlamp", 0)
+		const want = "service headlamp has multiple ports, specify the port in the URL (available: 9090/metrics, 8080/http)"
+		if err == nil || err.Error() != want {
+			t.Errorf("err wants %q but was %v", want, err)
+		}
+	})
+	t.Run("NoSuchPort", func(t *testing.T) {
+		r := newResolver(t, newService(corev1.ServicePort{Name: "http", Port: 8080}))
+		_, _, err := r.FindPodByServiceName(context.TODO(), "kube-system", "headlamp", 80)
+		const want = "service headlamp has no port 80 (available: 8080/http)"
+		if err == nil || err.Error() != want {
+			t.Errorf("err wants %q but was %v", want, err)
+		}
+	})
+	t.Run("NoSuchNamedTargetPort", func(t *testing.T) {
+		r := newResolver(t, newService(corev1.ServicePort{Port: 80, TargetPort: intstr.FromString("https")}))
+		_, _, err := r.FindPodByServiceName(context.TODO(), "kube-system", "headlamp", 0)
+		const want = "pod headlamp-12345678-12345678 has no container port named https (available: 9090/metrics, 4466/http)"
+		if err == nil || err.Error() != want {
+			t.Errorf("err wants %q but was %v", want, err)
+		}
+	})
+}
+
+func TestResolver_FindPodByServiceName_Readiness(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "headlamp", Namespace: "kube-system"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "headlamp"},
+			Ports:    []corev1.ServicePort{{Port: 4466}},
+		},
+	}
+	newPod := func(name string, phase corev1.PodPhase, ready corev1.ConditionStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "kube-system",
+				Labels:    map[string]string{"app": "headlamp"},
+			},
+			Status: corev1.PodStatus{
+				Phase:      phase,
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}},
+			},
+		}
+	}
+	newEndpointSlice := func(endpoints map[string]bool) *discoveryv1.EndpointSlice {
+		endpointSlice := &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "headlamp-abcde",
+				Namespace: "kube-system",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "headlamp"},
+			},
+		}
+		for name, ready := range endpoints {
+			endpointSlice.Endpoints = append(endpointSlice.Endpoints, discoveryv1.Endpoint{
+				Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+				TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: name},
+			})
+		}
+		return endpointSlice
+	}
+
+	t.Run("SkipNotReadyPods", func(t *testing.T) {
+		clientset := fake.NewClientset(
+			service,
+			newPod("headlamp-pending", corev1.PodPending, corev1.ConditionFalse),
+			newPod("headlamp-crashing", corev1.PodRunning, corev1.ConditionFalse),
+			newPod("headlamp-ready", corev1.PodRunning, corev1.ConditionTrue),
+		)
+		r := &Resolver{Logger: mock_logger.New(t), CoreV1: clientset.CoreV1(), DiscoveryV1: clientset.DiscoveryV1()}
+		pod, _, err := r.FindPodByServiceName(context.TODO(), "kube-system", "headlamp", 0)
+		if err != nil {
+			t.Fatalf("FindPodByServiceName error: %s", err)
+		}
+		if pod.Name != "headlamp-ready" {
+			t.Errorf("pod name wants headlamp-ready but was %s", pod.Name)
+		}
+	})
+	t.Run("SkipTerminatingPods", func(t *testing.T) {
+		terminating := newPod("headlamp-terminating", corev1.PodRunning, corev1.ConditionTrue)
+		terminating.DeletionTimestamp = &metav1.Time{}
+		terminating.Finalizers = []string{"example.com/finalizer"}
+		clientset := fake.NewClientset(
+			service,
+			terminating,
+			newPod("headlamp-ready", corev1.PodRunning, corev1.ConditionTrue),
+		)
+		r := &Resolver{Logger: mock_logger.New(t), CoreV1: clientset.CoreV1(), DiscoveryV1: clientset.DiscoveryV1()}
+		pod, _, err := r.FindPodByServiceName(context.TODO(), "kube-system", "headlamp", 0)
+		if err != nil {
+			t.Fatalf("FindPodByServiceName error: %s", err)
+		}
+		if pod.Name != "headlamp-ready" {
+			t.Errorf("pod name wants headlamp-ready but was %s", pod.Name)
+		}
+	})
+	t.Run("PreferEndpoints", func(t *testing.T) {
+		clientset := fake.NewClientset(
+			service,
+			newPod("headlamp-1", corev1.PodRunning, corev1.ConditionTrue),
+			newPod("headlamp-2", corev1.PodRunning, corev1.ConditionTrue),
+			newEndpointSlice(map[string]bool{"headlamp-1": false, "headlamp-2": true}),
+		)
+		r := &Resolver{Logger: mock_logger.New(t), CoreV1: clientset.CoreV1(), DiscoveryV1: clientset.DiscoveryV1()}
+		pod, _, err := r.FindPodByServiceName(context.TODO(), "kube-system", "headlamp", 0)
+		if err != nil {
+			t.Fatalf("FindPodByServiceName error: %s", err)
+		}
+		if pod.Name != "headlamp-2" {
+			t.Errorf("pod name wants headlamp-2 but was %s", pod.Name)
+		}
+	})
+	t.Run("NoReadyPod", func(t *testing.T) {
+		clientset := fake.NewClientset(
+			service,
+			newPod("headlamp-pending", corev1.PodPending, corev1.ConditionFalse),
+			newPod("headlamp-crashing", corev1.PodRunning, corev1.ConditionFalse),
+		)
+		r := &Resolver{Logger: mock_logger.New(t), CoreV1: clientset.CoreV1(), DiscoveryV1: clientset.DiscoveryV1()}
+		_, _, err := r.FindPodByServiceName(context.TODO(), "kube-system", "headlamp", 0)
+		const want = "no ready pod of service headlamp: pod headlamp-crashing is not ready, pod headlamp-pending is in phase Pending"
+		if err == nil || err.Error() != want {
+			t.Errorf("err wants %q but was %v", want, err)
+		}
+	})
+}
+
+func TestResolver_FindPodByWorkloadName(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "headlamp", Namespace: "kube-system"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "headlamp"}},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "headlamp-12345678-12345678",
+			Namespace: "kube-system",
+			Labels:    map[string]string{"app": "headlamp"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "headlamp", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 4466}}},
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	clientset := fake.NewClientset(deployment, pod)
+	r := &Resolver{Logger: mock_logger.New(t), CoreV1: clientset.CoreV1(), AppsV1: clientset.AppsV1()}
+	gotPod, gotPort, err := r.FindPodByWorkloadName(context.TODO(), "kube-system", WorkloadKindDeployment, "headlamp", 0)
+	if err != nil {
+		t.Fatalf("FindPodByWorkloadName error: %s", err)
+	}
+	if gotPod.Name != pod.Name {
+		t.Errorf("pod name wants %s but was %s", pod.Name, gotPod.Name)
+	}
+	if gotPort != 4466 {
+		t.Errorf("port wants 4466 but was %d", gotPort)
+	}
+}
+
+func TestResolver_FindPodByName(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "headlamp", Namespace: "kube-system"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "headlamp", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 4466}}},
+				{Name: "metrics", Ports: []corev1.ContainerPort{{Name: "metrics", ContainerPort: 9090}}},
+			},
+		},
+	}
+	r := &Resolver{Logger: mock_logger.New(t), CoreV1: fake.NewClientset(pod).CoreV1()}
+	t.Run("MultiplePorts", func(t *testing.T) {
+		_, gotPort, err := r.FindPodByName(context.TODO(), "kube-system", "headlamp", 0)
+		if err != nil {
+			t.Fatalf("FindPodByName error: %s", err)
+		}
+		if gotPort != 4466 {
+			t.Errorf("port wants 4466 but was %d", gotPort)
+		}
+	})
+	t.Run("Port", func(t *testing.T) {
+		_, gotPort, err := r.FindPodByName(context.TODO(), "kube-system", "headlamp", 9090)
+		if err != nil {
+			t.Fatalf("FindPodByName error: %s", err)
+		}
+		if gotPort != 9090 {
+			t.Errorf("port wants 9090 but was %d", gotPort)
+		}
+	})
+}
+
+func TestResolver_FindSecretData(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "headlamp-tls", Namespace: "kube-system"},
+		Data:       map[string][]byte{"ca.crt": []byte("CA")},
+	}
+	r := &Resolver{Logger: mock_logger.New(t), CoreV1: fake.NewClientset(secret).CoreV1()}
+	t.Run("Found", func(t *testing.T) {
+		data, err := r.FindSecretData(context.TODO(), "kube-system", "headlamp-tls", "ca.crt")
+		if err != nil {
+			t.Fatalf("FindSecretData error: %s", err)
+		}
+		if string(data) != "CA" {
+			t.Errorf("data wants CA but was %s", data)
+		}
+	})
+	t.Run("NoKey", func(t *testing.T) {
+		_, err := r.FindSecretData(context.TODO(), "kube-system", "headlamp-tls", "tls.crt")
+		if want := "secret headlamp-tls has no key tls.crt"; err == nil || err.Error() != want {
+			t.Errorf("error wants %s but was %v", want, err)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// PACPath is the path of the proxy auto-config file in the forward proxy mode.
+const PACPath = "/proxy.pac"
+
+// ForwardProxyOption represents an option of the forward proxy mode.
+type ForwardProxyOption struct {
+	// Domains is the domain suffixes of the hosts to accept, e.g. svc.
+	// A request to any other host is refused.
+	Domains []string
+	// Route returns the route to the host and port of an absolute-URI request.
+	// The port is empty if it is not specified in the URI.
+	// PathPrefix and StripPrefix of the route are ignored.
+	Route func(ctx context.Context, host, port string) (Route, error)
+	// Dial returns a connection to the host and port of a CONNECT request.
+	// If nil, a CONNECT request is refused.
+	Dial func(ctx context.Context, host, port string) (net.Conn, error)
+}
+
+// forwardProxy accepts CONNECT and absolute-URI requests to the hosts of the domains.
+// It requires the Proxy-Authorization header with the password,
+// so that the other users or processes on the same host cannot use the credential.
+// It serves the PAC file for an origin-form request.
+type forwardProxy struct {
+	o              *ForwardProxyOption
+	password       string
+	boundURL       *url.URL
+	headersToStrip []string
+}
+
+func (fp *forwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+		if r.Method == http.MethodGet && r.URL.Path == PACPath {
+			fp.servePAC(w)
+			return
+		}
+		errorPage(w, http.StatusNotFound,
+			fmt.Sprintf("This is a forward proxy. Set %s as the HTTP proxy, or %s as the proxy auto-config URL.",
+				fp.boundURL.Host, fp.boundURL.JoinPath(PACPath)))
+		return
+	}
+	if !fp.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="kauthproxy"`)
+		errorPage(w, http.StatusProxyAuthRequired, "Set the password shown by kauthproxy in the terminal.")
+		return
+	}
+	hostport := r.Host
+	if r.Method != http.MethodConnect {
+		hostport = r.URL.Host
+	}
+	host, port := hostport, ""
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		host, port = h, p
+	}
+	if !fp.allowed(host) {
+		errorPage(w, http.StatusForbidden, fmt.Sprintf("Host %s is not allowed. The forward proxy accepts only *.%s.",
+			host, strings.Join(fp.o.Domains, ", *.")))
+		return
+	}
+	if r.Method == http.MethodConnect {
+		fp.tunnel(w, r, host, port)
+		return
+	}
+	if r.URL.Scheme != "http" {
+		errorPage(w, http.StatusBadRequest, fmt.Sprintf("Scheme %s is not supported.", r.URL.Scheme))
+		return
+	}
+	route, err := fp.o.Route(r.Context(), host, port)
+	if err != nil {
+		writePage(w, http.StatusBadGateway, fmt.Sprintf("%d %s", http.StatusBadGateway, http.StatusText(http.StatusBadGateway)),
+			fmt.Sprintf("Could not forward to %s: %s", hostport, err))
+		return
+	}
+	route.PathPrefix, route.StripPrefix = "", false
+	proxy := newProxy(route, "", fp.headersToStrip)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// keep the host of the request, so that the upstream generates a URL of the host
+		r.Host = hostport
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+func (fp *forwardProxy) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return false
+	}
+	// Proxy-Authorization has the same syntax as Authorization
+	_, password, ok := (&http.Request{Header: http.Header{"Authorization": {auth}}}).BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(fp.password)) == 1
+}
+
+func (fp *forwardProxy) allowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range fp.o.Domains {
+		if strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnel connects the client to the upstream.
+// It does not add the credential, because the client sends a request over TLS.
+func (fp *forwardProxy) tunnel(w http.ResponseWriter, r *http.Request, host, port string) {
+	if fp.o.Dial == nil {
+		errorPage(w, http.StatusMethodNotAllowed, "CONNECT is not allowed in the read-only mode or with a policy.")
+		return
+	}
+	upstream, err := fp.o.Dial(r.Context(), host, port)
+	if err != nil {
+		writePage(w, http.StatusBadGateway, fmt.Sprintf("%d %s", http.StatusBadGateway, http.StatusText(http.StatusBadGateway)),
+			fmt.Sprintf("Could not connect to %s:%s: %s", host, port, err))
+		return
+	}
+	defer upstream.Close()
+	client, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		errorPage(w, http.StatusInternalServerError, fmt.Sprintf("Could not hijack the connection: %s", err))
+		return
+	}
+	defer client.Close()
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// the buffer may contain the data sent by the client after the request
+		_, _ = io.Copy(upstream, buf)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+// servePAC writes the proxy auto-config file to send only the requests to the domains via the forward proxy.
+func (fp *forwardProxy) servePAC(w http.ResponseWriter) {
+	var conditions []string
+	for _, domain := range fp.o.Domains {
+		conditions = append(conditions, fmt.Sprintf("dnsDomainIs(host, %q)", "."+domain))
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	_, _ = fmt.Fprintf(w, `function FindProxyForURL(url, host) {
+  if (%s) {
+    return "PROXY %s";
+  }
+  return "DIRECT";
+}
+`, strings.Join(conditions, " || "), fp.boundURL.Host)
+}
@@ -0,0 +1,125 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestReverseProxy_Run_ForwardProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s %s %s", r.Host, r.URL.Path, r.Header.Get("Proxy-Authorization"))
+	})
+	upstream := httptest.NewServer(handler)
+	defer upstream.Close()
+	tlsUpstream := httptest.NewTLSServer(handler)
+	defer tlsUpstream.Close()
+	newForwardProxyOption := func(t *testing.T) *ForwardProxyOption {
+		return &ForwardProxyOption{
+			Domains: []string{"svc"},
+			Route: func(ctx context.Context, host, port string) (Route, error) {
+				if host != "grafana.monitoring.svc" || port != "" {
+					t.Errorf("Route wants grafana.monitoring.svc without port but was %s:%s", host, port)
+				}
+				return newRoute(t, "", false, upstream), nil
+			},
+			Dial: func(ctx context.Context, host, port string) (net.Conn, error) {
+				if host != "argocd.argocd.svc" || port != "443" {
+					t.Errorf("Dial wants argocd.argocd.svc:443 but was %s:%s", host, port)
+				}
+				return net.Dial("tcp", tlsUpstream.Listener.Addr().String())
+			},
+		}
+	}
+	newClient := func(rpURL *url.URL, password string) *http.Client {
+		proxyURL := *rpURL
+		if password != "" {
+			proxyURL.User = url.UserPassword("kauthproxy", password)
+		}
+		return &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyURL(&proxyURL),
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+	}
+	get := func(t *testing.T, client *http.Client, u string) (int, string) {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatalf("could not send a request: %s", err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read the body: %s", err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	t.Run("AbsoluteURI", func(t *testing.T) {
+		rpURL := runReverseProxy(t, upstream, Option{LoginCode: "PASSWORD", ForwardProxy: newForwardProxyOption(t)})
+		code, body := get(t, newClient(rpURL, "PASSWORD"), "http://grafana.monitoring.svc/d/home")
+		if code != http.StatusOK {
+			t.Errorf("status wants %d but was %d", http.StatusOK, code)
+		}
+		// the Proxy-Authorization header is not sent to the upstream
+		if want := "grafana.monitoring.svc /d/home "; body != want {
+			t.Errorf("body wants %q but was %q", want, body)
+		}
+	})
+	t.Run("Connect", func(t *testing.T) {
+		rpURL := runReverseProxy(t, upstream, Option{LoginCode: "PASSWORD", ForwardProxy: newForwardProxyOption(t)})
+		code, body := get(t, newClient(rpURL, "PASSWORD"), "https://argocd.argocd.svc/applications")
+		if code != http.StatusOK {
+			t.Errorf("status wants %d but was %d", http.StatusOK, code)
+		}
+		if want := "argocd.argocd.svc /applications "; body != want {
+			t.Errorf("body wants %q but was %q", want, body)
+		}
+	})
+	t.Run("ConnectInReadOnlyMode", func(t *testing.T) {
+		rpURL := runReverseProxy(t, upstream, Option{
+			LoginCode:    "PASSWORD",
+			ForwardProxy: newForwardProxyOption(t),
+			ReadOnly:     &ReadOnlyOption{},
+		})
+		if _, err := newClient(rpURL, "PASSWORD").Get("https://argocd.argocd.svc/"); err == nil {
+			t.Errorf("CONNECT wants an error but was nil")
+		}
+	})
+	t.Run("WrongPassword", func(t *testing.T) {
+		rpURL := runReverseProxy(t, upstream, Option{LoginCode: "PASSWORD", ForwardProxy: newForwardProxyOption(t)})
+		for _, password := range []string{"", "WRONG"} {
+			code, _ := get(t, newClient(rpURL, password), "http://grafana.monitoring.svc/")
+			if code != http.StatusProxyAuthRequired {
+				t.Errorf("status wants %d but was %d", http.StatusProxyAuthRequired, code)
+			}
+		}
+	})
+	t.Run("UnrelatedHost", func(t *testing.T) {
+		rpURL := runReverseProxy(t, upstream, Option{LoginCode: "PASSWORD", ForwardProxy: newForwardProxyOption(t)})
+		code, _ := get(t, newClient(rpURL, "PASSWORD"), "http://example.com/")
+		if code != http.StatusForbidden {
+			t.Errorf("status wants %d but was %d", http.StatusForbidden, code)
+		}
+	})
+	t.Run("PAC", func(t *testing.T) {
+		rpURL := runReverseProxy(t, upstream, Option{LoginCode: "PASSWORD", ForwardProxy: newForwardProxyOption(t)})
+		code, body := get(t, http.DefaultClient, rpURL.JoinPath(PACPath).String())
+		if code != http.StatusOK {
+			t.Errorf("status wants %d but was %d", http.StatusOK, code)
+		}
+		for _, want := range []string{`dnsDomainIs(host, ".svc")`, fmt.Sprintf(`"PROXY %s"`, rpURL.Host)} {
+			if !strings.Contains(body, want) {
+				t.Errorf("PAC wants %s but was %s", want, body)
+			}
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// PolicyAction represents an action of a policy rule.
+type PolicyAction string
+
+const (
+	// PolicyActionAllow forwards the request.
+	PolicyActionAllow PolicyAction = "allow"
+	// PolicyActionDeny rejects the request with 403.
+	PolicyActionDeny PolicyAction = "deny"
+	// PolicyActionLog logs the request and continues to evaluate the next rules.
+	PolicyActionLog PolicyAction = "log"
+)
+
+// Policy represents the rules to allow or deny a request.
+// The rules are evaluated in order, and the first allow or deny rule matched to the request is applied.
+// If no rule is matched, DefaultAction is applied.
+type Policy struct {
+	// DefaultAction is allow or deny. Defaults to allow.
+	DefaultAction PolicyAction `json:"defaultAction,omitempty"`
+	Rules         []PolicyRule `json:"rules"`
+}
+
+// PolicyRule represents a rule of the policy.
+// A request matches to the rule if all of the conditions are matched.
+// An empty condition matches to any request.
+type PolicyRule struct {
+	Name string `json:"name,omitempty"`
+	// Methods is a list of HTTP methods, e.g. GET.
+	Methods []string `json:"methods,omitempty"`
+	// Paths is a list of path patterns.
+	// See path.Match for the syntax, and a pattern ending with /** matches to all descendants.
+	Paths []string `json:"paths,omitempty"`
+	// Headers is a map of header name to pattern of the value.
+	// See path.Match for the syntax.
+	Headers map[string]string `json:"headers,omitempty"`
+	Action  PolicyAction      `json:"action"`
+}
+
+// ParsePolicy parses and validates the policy in YAML.
+func ParsePolicy(b []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.UnmarshalStrict(b, &p); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+	switch p.DefaultAction {
+	case "":
+		p.DefaultAction = PolicyActionAllow
+	case PolicyActionAllow, PolicyActionDeny:
+	default:
+		return nil, fmt.Errorf("defaultAction must be allow or deny but was %s", p.DefaultAction)
+	}
+	for i := range p.Rules {
+		if err := p.Rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("invalid rule %s: %w", p.Rules[i].displayName(i), err)
+		}
+	}
+	return &p, nil
+}
+
+func (r *PolicyRule) validate() error {
+	switch r.Action {
+	case PolicyActionAllow, PolicyActionDeny, PolicyActionLog:
+	default:
+		return fmt.Errorf("action must be allow, deny or log but was %q", r.Action)
+	}
+	for i, method := range r.Methods {
+		r.Methods[i] = strings.ToUpper(method)
+	}
+	for _, pattern := range r.Paths {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+			return fmt.Errorf("invalid path pattern %s: %w", pattern, err)
+		}
+	}
+	for name, pattern := range r.Headers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern of header %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) displayName(i int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+func (r *PolicyRule) match(req *http.Request) bool {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, req.Method) {
+		return false
+	}
+	if len(r.Paths) > 0 && !matchAnyPath(r.Paths, req.URL.Path) {
+		return false
+	}
+	for name, pattern := range r.Headers {
+		ok, err := path.Match(pattern, req.Header.Get(name))
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// enforcePolicy wraps the handler to allow or deny a request by the policy.
+func (rp *ReverseProxy) enforcePolicy(h http.Handler, p *Policy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action, ruleName := p.DefaultAction, "default"
+		for i, rule := range p.Rules {
+			if !rule.match(r) {
+				continue
+			}
+			if rule.Action == PolicyActionLog {
+				rp.Logger.Printf("Policy %s: %s %s", rule.displayName(i), r.Method, r.URL.Path)
+				continue
+			}
+			action, ruleName = rule.Action, rule.displayName(i)
+			break
+		}
+		if action == PolicyActionDeny {
+			rp.Logger.V(1).Infof("denied %s %s by the policy %s", r.Method, r.URL.Path, ruleName)
+			errorPage(w, http.StatusForbidden,
+				fmt.Sprintf("%s %s is denied by the policy %s.", r.Method, r.URL.Path, ruleName))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,112 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		p, err := ParsePolicy([]byte(`
+defaultAction: deny
+rules:
+  - name: admin
+    paths: ["/admin/**"]
+    action: deny
+  - methods: [get]
+    action: allow
+`))
+		if err != nil {
+			t.Fatalf("ParsePolicy error: %s", err)
+		}
+		if p.DefaultAction != PolicyActionDeny {
+			t.Errorf("DefaultAction wants deny but was %s", p.DefaultAction)
+		}
+		if want := "GET"; p.Rules[1].Methods[0] != want {
+			t.Errorf("Methods[0] wants %s but was %s", want, p.Rules[1].Methods[0])
+		}
+	})
+	t.Run("UnknownAction", func(t *testing.T) {
+		_, err := ParsePolicy([]byte(`
+rules:
+  - paths: ["/admin"]
+    action: drop
+`))
+		if want := `invalid rule #1: action must be allow, deny or log but was "drop"`; err == nil || err.Error() != want {
+			t.Errorf("error wants %s but was %v", want, err)
+		}
+	})
+	t.Run("UnknownField", func(t *testing.T) {
+		if _, err := ParsePolicy([]byte(`rule: []`)); err == nil {
+			t.Errorf("error wants non-nil but was nil")
+		}
+	})
+}
+
+func TestReverseProxy_Run_Policy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+	policy, err := ParsePolicy([]byte(`
+defaultAction: deny
+rules:
+  - name: audit
+    methods: [POST]
+    action: log
+  - name: admin
+    paths: ["/admin/**"]
+    action: deny
+  - name: api
+    methods: [POST]
+    paths: ["/api/*"]
+    headers:
+      Content-Type: application/json
+    action: allow
+  - name: read
+    methods: [GET]
+    action: allow
+`))
+	if err != nil {
+		t.Fatalf("ParsePolicy error: %s", err)
+	}
+	rpURL := runReverseProxy(t, upstream, Option{Policy: policy})
+	for _, c := range []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		want        int
+	}{
+		{name: "Read", method: http.MethodGet, path: "/index.html", want: http.StatusOK},
+		{name: "Admin", method: http.MethodGet, path: "/admin/users", want: http.StatusForbidden},
+		{name: "AdminDoubleSlash", method: http.MethodGet, path: "//admin/users", want: http.StatusForbidden},
+		{name: "AdminDotDot", method: http.MethodGet, path: "/x/../admin/users", want: http.StatusForbidden},
+		{name: "AdminDot", method: http.MethodGet, path: "/./admin/users", want: http.StatusForbidden},
+		{name: "AdminEncodedDotDot", method: http.MethodGet, path: "/x/%2e%2e/admin/users", want: http.StatusForbidden},
+		{name: "API", method: http.MethodPost, path: "/api/query", contentType: "application/json", want: http.StatusOK},
+		{name: "APIWithoutContentType", method: http.MethodPost, path: "/api/query", want: http.StatusForbidden},
+		{name: "Default", method: http.MethodDelete, path: "/index.html", want: http.StatusForbidden},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			// the path is sent as-is
+			req, err := http.NewRequest(c.method, rpURL.String()+c.path, nil)
+			if err != nil {
+				t.Fatalf("could not create a request: %s", err)
+			}
+			if c.contentType != "" {
+				req.Header.Set("Content-Type", c.contentType)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not send a request: %s", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != c.want {
+				t.Errorf("status wants %d but was %d", c.want, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// protect wraps the handler to reject the requests from another site.
+//
+// A web page in the browser can send a request to the loopback address,
+// and the reverse proxy would forward it with the credential of the user.
+// To prevent this,
+//
+//   - It rejects a request with a Host header other than the bound address,
+//     to prevent DNS rebinding.
+//     If virtualHost is set, it allows a subdomain of localhost on the same port.
+//   - It rejects a cross-origin request of a state-changing method,
+//     based on the Origin and Sec-Fetch-Site headers.
+//   - It rejects a cross-origin WebSocket handshake.
+func protect(h http.Handler, boundURL *url.URL, virtualHost bool) http.Handler {
+	allowedHosts := allowedHostsOf(boundURL)
+	h = protectCrossOrigin(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(allowedHosts, strings.ToLower(r.Host)) && !(virtualHost && isVirtualHostOf(r.Host, boundURL)) {
+			errorPage(w, http.StatusForbidden, fmt.Sprintf("Host %s is not allowed. Open %s instead.", r.Host, boundURL))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// protectCrossOrigin wraps the handler to reject a cross-origin request of a state-changing method,
+// and a cross-origin WebSocket handshake.
+func protectCrossOrigin(h http.Handler) http.Handler {
+	cop := http.NewCrossOriginProtection()
+	cop.SetDenyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errorPage(w, http.StatusForbidden, "Cross-origin request is not allowed.")
+	}))
+	h = cop.Handler(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketUpgrade(r) && !isSameOrigin(r) {
+			errorPage(w, http.StatusForbidden, "Cross-origin WebSocket is not allowed.")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowedHostsOf returns the hosts of the bound address, including localhost.
+func allowedHostsOf(u *url.URL) []string {
+	port := u.Port()
+	hosts := []string{strings.ToLower(u.Host)}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && ip.IsLoopback() {
+		hosts = append(hosts, net.JoinHostPort("localhost", port))
+	}
+	return hosts
+}
+
+// isVirtualHostOf returns true if the host is a virtual host on the port of the bound address.
+func isVirtualHostOf(host string, boundURL *url.URL) bool {
+	_, port, err := net.SplitHostPort(host)
+	if err != nil || port != boundURL.Port() {
+		return false
+	}
+	_, ok := virtualHostName(host)
+	return ok
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// not sent by a browser
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func errorPage(w http.ResponseWriter, code int, message string) {
+	writePage(w, code, fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		message, "kauthproxy rejected this request to protect your cluster credential.")
+}
+
+func writePage(w http.ResponseWriter, code int, title string, paragraphs ...string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	var body strings.Builder
+	for _, p := range paragraphs {
+		_, _ = fmt.Fprintf(&body, "<p>%s</p>\n", html.EscapeString(p))
+	}
+	_, _ = fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><title>%s</title></head>
+<body>
+<h1>%s</h1>
+%s</body>
+</html>
+`, html.EscapeString(title), html.EscapeString(title), body.String())
+}
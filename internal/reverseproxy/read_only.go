@@ -0,0 +1,78 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// readOnly wraps the handler to forward only the requests which do not change the state,
+// i.e. GET, HEAD and OPTIONS.
+// A WebSocket handshake is a GET request but it can send any message,
+// so it is forwarded only if the path matches to one of webSocketPaths.
+func readOnly(h http.Handler, webSocketPaths []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			errorPage(w, http.StatusMethodNotAllowed,
+				fmt.Sprintf("Method %s is not allowed in the read-only mode.", r.Method))
+			return
+		}
+		if isWebSocketUpgrade(r) && !matchAnyPath(webSocketPaths, r.URL.Path) {
+			errorPage(w, http.StatusMethodNotAllowed,
+				fmt.Sprintf("WebSocket to %s is not allowed in the read-only mode.", r.URL.Path))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func matchAnyPath(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath reports whether the path matches to the pattern of path.Match.
+// A pattern ending with /** matches to the path and all its descendants.
+func matchPath(pattern, p string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return p == prefix || strings.HasPrefix(p, prefix+"/")
+	}
+	ok, err := path.Match(pattern, p)
+	return err == nil && ok
+}
+
+// normalizePath wraps the handler to clean the path of a request, e.g. //a/./b/../c to /a/c,
+// so that a path pattern is matched to the path which the upstream serves.
+// The cleaned path is forwarded to the upstream.
+func normalizePath(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := cleanPath(r.URL.Path)
+		if p != r.URL.Path {
+			r = r.Clone(r.Context())
+			r.URL.Path = p
+			r.URL.RawPath = ""
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// cleanPath returns the shortest path equivalent to the path by path.Clean.
+// It keeps a trailing slash.
+func cleanPath(p string) string {
+	if p == "" {
+		return p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
@@ -3,12 +3,16 @@ package reverseproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
+	"strings"
 
 	"github.com/google/wire"
+	"github.com/int128/kauthproxy/internal/logger"
 	"github.com/int128/listener"
 )
 
@@ -24,6 +28,40 @@ type Option struct {
 	TargetScheme          string
 	TargetHost            string
 	TargetPort            int
+	// TargetPathPrefix is prepended to the path of a request, e.g. /api/v1/namespaces/NS/services/NAME/proxy.
+	// It is stripped from the Location and Set-Cookie headers of a response.
+	TargetPathPrefix string
+	// TLSCertificate is the certificate to serve over HTTPS.
+	// If nil, it serves over HTTP.
+	TLSCertificate *tls.Certificate
+	// LoginCode is the one-time code of the launch URL, see LoginPath.
+	// If set, it rejects a request without the session cookie.
+	LoginCode string
+	// ReadOnly forwards only GET, HEAD and OPTIONS requests.
+	// If nil, it forwards any request.
+	ReadOnly *ReadOnlyOption
+	// Policy allows or denies a request by the rules.
+	// If nil, it forwards any request.
+	Policy *Policy
+	// StripHeaders is the headers removed from a request in addition to DefaultStripHeaders.
+	// A name ending with * matches to the prefix.
+	StripHeaders []string
+	// Routes is the routes to targets by the path prefix.
+	// If set, the target fields are ignored.
+	Routes []Route
+	// VirtualHost routes a request by the Host header, i.e. NAME.localhost.
+	// If set, the target fields and Routes are ignored.
+	VirtualHost *VirtualHostOption
+	// ForwardProxy serves as a forward proxy, and LoginCode is used as the password of it.
+	// If set, the target fields, Routes and VirtualHost are ignored.
+	ForwardProxy *ForwardProxyOption
+}
+
+// ReadOnlyOption represents an option of the read-only mode.
+type ReadOnlyOption struct {
+	// WebSocketPaths is the patterns of path to allow a WebSocket handshake.
+	// See path.Match for the syntax, and a pattern ending with /** matches to all descendants.
+	WebSocketPaths []string
 }
 
 type Interface interface {
@@ -36,6 +74,7 @@ type Instance interface {
 }
 
 type ReverseProxy struct {
+	Logger logger.Interface
 }
 
 // Run executes a reverse proxy server.
@@ -46,40 +85,171 @@ type ReverseProxy struct {
 // It will send the Instance to the readyChan when the reverse proxy is ready.
 // Caller should close the readyChan.
 func (rp *ReverseProxy) Run(o Option, readyChan chan<- Instance) error {
-	s := &http.Server{
-		Handler: &httputil.ReverseProxy{
-			Transport: o.Transport,
-			Director: func(r *http.Request) {
-				r.URL.Scheme = o.TargetScheme
-				r.URL.Host = fmt.Sprintf("%s:%d", o.TargetHost, o.TargetPort)
-				r.Host = ""
-			},
-		},
-	}
 	l, err := listener.New(o.BindAddressCandidates)
 	if err != nil {
 		return fmt.Errorf("could not listen: %w", err)
 	}
 	// l will be closed by s.Serve(l)
 
+	s := &http.Server{}
+	u := *l.URL
+	if o.TLSCertificate != nil {
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*o.TLSCertificate}}
+		u.Scheme = "https"
+	}
+	headersToStrip := append(slices.Clone(DefaultStripHeaders), o.StripHeaders...)
+	switch {
+	case o.ForwardProxy != nil:
+		fpo := *o.ForwardProxy
+		if o.ReadOnly != nil || o.Policy != nil {
+			// a tunnel bypasses the read-only mode and policy
+			fpo.Dial = nil
+		}
+		s.Handler = &forwardProxy{o: &fpo, password: o.LoginCode, boundURL: &u, headersToStrip: headersToStrip}
+	case o.VirtualHost != nil:
+		s.Handler = &virtualHostRouter{route: o.VirtualHost.Route, headersToStrip: headersToStrip}
+	case len(o.Routes) > 0:
+		s.Handler = newRouter(o.Routes, headersToStrip)
+	default:
+		s.Handler = newProxy(Route{
+			Transport:    o.Transport,
+			TargetScheme: o.TargetScheme,
+			TargetHost:   o.TargetHost,
+			TargetPort:   o.TargetPort,
+		}, o.TargetPathPrefix, headersToStrip)
+	}
+	if o.Policy != nil {
+		s.Handler = rp.enforcePolicy(s.Handler, o.Policy)
+	}
+	if o.ReadOnly != nil {
+		s.Handler = readOnly(s.Handler, o.ReadOnly.WebSocketPaths)
+	}
+	if o.ReadOnly != nil || o.Policy != nil {
+		s.Handler = normalizePath(s.Handler)
+	}
+	if o.ForwardProxy != nil {
+		// a forward proxy authenticates a client by the Proxy-Authorization header instead of the session,
+		// and accepts a request to any host of the domains
+		s.Handler = protectCrossOrigin(s.Handler)
+	} else {
+		if o.LoginCode != "" {
+			h, err := newSession(s.Handler, o.LoginCode, &u, o.VirtualHost != nil)
+			if err != nil {
+				_ = l.Close()
+				return fmt.Errorf("could not start a session: %w", err)
+			}
+			s.Handler = h
+		}
+		s.Handler = protect(s.Handler, &u, o.VirtualHost != nil)
+	}
 	if readyChan != nil {
-		readyChan <- &instance{s: s, l: l}
+		readyChan <- &instance{s: s, u: &u}
 	}
-	if err := s.Serve(l); err != nil && err != http.ErrServerClosed {
+	if err := serve(s, l); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("could not start a server: %w", err)
 	}
 	return nil
 }
 
+// newProxy returns a reverse proxy to the target of the route.
+// If targetPathPrefix is set, it is prepended to the path of a request.
+func newProxy(route Route, targetPathPrefix string, headersToStrip []string) *httputil.ReverseProxy {
+	targetHost := fmt.Sprintf("%s:%d", route.TargetHost, route.TargetPort)
+	return &httputil.ReverseProxy{
+		Transport: route.Transport,
+		Director: func(r *http.Request) {
+			r.URL.Scheme = route.TargetScheme
+			r.URL.Host = targetHost
+			r.Host = ""
+			if route.StripPrefix {
+				stripRoutePrefix(r.URL, route.PathPrefix)
+			}
+			addPathPrefix(r.URL, targetPathPrefix)
+			stripHeaders(r.Header, headersToStrip)
+			// prevent httputil.ReverseProxy from appending the address of the client
+			r.Header["X-Forwarded-For"] = nil
+		},
+		ModifyResponse: func(r *http.Response) error {
+			stripPathPrefix(r, targetHost, targetPathPrefix)
+			if route.StripPrefix {
+				addRoutePrefix(r, targetHost, route.PathPrefix)
+			}
+			return nil
+		},
+	}
+}
+
+func serve(s *http.Server, l *listener.Listener) error {
+	if s.TLSConfig != nil {
+		return s.ServeTLS(l, "", "")
+	}
+	return s.Serve(l)
+}
+
 type instance struct {
 	s *http.Server
-	l *listener.Listener
+	u *url.URL
 }
 
 func (i *instance) URL() *url.URL {
-	return i.l.URL
+	return i.u
 }
 
 func (i *instance) Shutdown(ctx context.Context) error {
 	return i.s.Shutdown(ctx)
 }
+
+// addPathPrefix prepends the prefix to the path.
+// If the path already has the prefix, such as a link rewritten by the upstream, it does nothing.
+func addPathPrefix(u *url.URL, prefix string) {
+	if prefix == "" || hasPathPrefix(u.Path, prefix) {
+		return
+	}
+	u.Path = prefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = prefix + u.RawPath
+	}
+}
+
+// stripPathPrefix removes the prefix from the Location and Set-Cookie headers,
+// so that the browser stays on the reverse proxy.
+func stripPathPrefix(r *http.Response, targetHost, prefix string) {
+	if prefix == "" {
+		return
+	}
+	if location := r.Header.Get("Location"); location != "" {
+		if u, err := url.Parse(location); err == nil && (u.Host == "" || u.Host == targetHost) {
+			if hasPathPrefix(u.Path, prefix) {
+				u.Scheme, u.Host, u.User = "", "", nil
+				u.Path = trimPathPrefix(u.Path, prefix)
+				u.RawPath = ""
+				r.Header.Set("Location", u.String())
+			}
+		}
+	}
+	cookies := r.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	r.Header.Del("Set-Cookie")
+	for _, v := range cookies {
+		c, err := http.ParseSetCookie(v)
+		if err != nil || !hasPathPrefix(c.Path, prefix) {
+			r.Header.Add("Set-Cookie", v)
+			continue
+		}
+		c.Path = trimPathPrefix(c.Path, prefix)
+		r.Header.Add("Set-Cookie", c.String())
+	}
+}
+
+func hasPathPrefix(p, prefix string) bool {
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func trimPathPrefix(p, prefix string) string {
+	if p == prefix {
+		return "/"
+	}
+	return strings.TrimPrefix(p, prefix)
+}
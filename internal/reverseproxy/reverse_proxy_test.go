@@ -0,0 +1,370 @@
+package reverseproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/int128/kauthproxy/internal/certificate"
+	"github.com/int128/kauthproxy/internal/logger/mock_logger"
+)
+
+// runReverseProxy starts a reverse proxy to the upstream server and returns the URL.
+func runReverseProxy(t *testing.T, upstream *httptest.Server, o Option) *url.URL {
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("could not parse the upstream URL: %s", err)
+	}
+	port, err := strconv.Atoi(upstreamURL.Port())
+	if err != nil {
+		t.Fatalf("could not parse the upstream port: %s", err)
+	}
+	o.Transport = http.DefaultTransport
+	o.BindAddressCandidates = []string{"127.0.0.1:0"}
+	o.TargetScheme = "http"
+	o.TargetHost = upstreamURL.Hostname()
+	o.TargetPort = port
+
+	rp := ReverseProxy{Logger: mock_logger.New(t)}
+	readyChan := make(chan Instance, 1)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- rp.Run(o, readyChan)
+	}()
+	instance := <-readyChan
+	t.Cleanup(func() {
+		if err := instance.Shutdown(context.TODO()); err != nil {
+			t.Errorf("could not shutdown the reverse proxy: %s", err)
+		}
+		if err := <-errChan; err != nil {
+			t.Errorf("reverse proxy error: %s", err)
+		}
+	})
+	return instance.URL()
+}
+
+func TestReverseProxy_Run(t *testing.T) {
+	t.Run("StripHeaders", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, key := range slices.Sorted(maps.Keys(r.Header)) {
+				_, _ = fmt.Fprintf(w, "%s,", key)
+			}
+		}))
+		defer upstream.Close()
+		rpURL := runReverseProxy(t, upstream, Option{StripHeaders: []string{"X-Grafana-*"}})
+		req, err := http.NewRequest(http.MethodGet, rpURL.String(), nil)
+		if err != nil {
+			t.Fatalf("could not create a request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer spoofed")
+		req.Header.Set("Impersonate-User", "admin")
+		req.Header.Set("Impersonate-Group", "system:masters")
+		req.Header.Set("X-Remote-User", "admin")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		req.Header.Set("X-Grafana-User", "admin")
+		req.Header.Set("X-Keep", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("could not send a request: %s", err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read the body: %s", err)
+		}
+		if want := "Accept-Encoding,User-Agent,X-Keep,"; string(b) != want {
+			t.Errorf("headers wants %s but was %s", want, b)
+		}
+	})
+	t.Run("ReadOnly", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, r.URL.Path)
+		}))
+		defer upstream.Close()
+		rpURL := runReverseProxy(t, upstream, Option{
+			ReadOnly: &ReadOnlyOption{WebSocketPaths: []string{"/api/ws", "/stream/**"}},
+		})
+		for _, c := range []struct {
+			name      string
+			method    string
+			path      string
+			websocket bool
+			want      int
+			// wantPath is the path received by the upstream
+			wantPath string
+		}{
+			{name: "Get", method: http.MethodGet, path: "/", want: http.StatusOK},
+			{name: "Head", method: http.MethodHead, path: "/", want: http.StatusOK},
+			{name: "Post", method: http.MethodPost, path: "/", want: http.StatusMethodNotAllowed},
+			{name: "Delete", method: http.MethodDelete, path: "/", want: http.StatusMethodNotAllowed},
+			{name: "WebSocketAllowed", method: http.MethodGet, path: "/api/ws", websocket: true, want: http.StatusOK},
+			{name: "WebSocketDescendant", method: http.MethodGet, path: "/stream/logs", websocket: true, want: http.StatusOK},
+			{name: "WebSocketDenied", method: http.MethodGet, path: "/exec", websocket: true, want: http.StatusMethodNotAllowed},
+			{name: "WebSocketDotDot", method: http.MethodGet, path: "/stream/../exec", websocket: true, want: http.StatusMethodNotAllowed},
+			{name: "WebSocketDoubleSlash", method: http.MethodGet, path: "//api/ws", websocket: true, want: http.StatusOK, wantPath: "/api/ws"},
+			{name: "WebSocketDot", method: http.MethodGet, path: "/./api/ws", websocket: true, want: http.StatusOK, wantPath: "/api/ws"},
+			{name: "TrailingSlash", method: http.MethodGet, path: "/x/../stream/", want: http.StatusOK, wantPath: "/stream/"},
+		} {
+			t.Run(c.name, func(t *testing.T) {
+				// the path is sent as-is
+				req, err := http.NewRequest(c.method, rpURL.String()+c.path, nil)
+				if err != nil {
+					t.Fatalf("could not create a request: %s", err)
+				}
+				if c.websocket {
+					req.Header.Set("Connection", "Upgrade")
+					req.Header.Set("Upgrade", "websocket")
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("could not send a request: %s", err)
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != c.want {
+					t.Errorf("status wants %d but was %d", c.want, resp.StatusCode)
+				}
+				if c.wantPath != "" {
+					b, err := io.ReadAll(resp.Body)
+					if err != nil {
+						t.Fatalf("could not read the body: %s", err)
+					}
+					if string(b) != c.wantPath {
+						t.Errorf("upstream path wants %s but was %s", c.wantPath, b)
+					}
+				}
+			})
+		}
+	})
+	t.Run("Session", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, r.Header.Get("Cookie"))
+		}))
+		defer upstream.Close()
+		rpURL := runReverseProxy(t, upstream, Option{LoginCode: "LOGIN_CODE"})
+		client := &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		get := func(t *testing.T, u string, cookies ...*http.Cookie) *http.Response {
+			req, err := http.NewRequest(http.MethodGet, u, nil)
+			if err != nil {
+				t.Fatalf("could not create a request: %s", err)
+			}
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("could not send a request: %s", err)
+			}
+			t.Cleanup(func() { _ = resp.Body.Close() })
+			return resp
+		}
+		loginURL := rpURL.JoinPath(LoginPath).String()
+
+		if resp := get(t, rpURL.String()); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status without cookie wants %d but was %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+		if resp := get(t, loginURL+"?code=WRONG"); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status of wrong code wants %d but was %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+		resp := get(t, loginURL+"?code=LOGIN_CODE")
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("status of login wants %d but was %d", http.StatusFound, resp.StatusCode)
+		}
+		cookies := resp.Cookies()
+		if len(cookies) != 1 || !cookies[0].HttpOnly {
+			t.Fatalf("cookies wants an HttpOnly cookie but was %+v", cookies)
+		}
+		if resp := get(t, loginURL+"?code=LOGIN_CODE"); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status of used code wants %d but was %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+		resp = get(t, rpURL.String(), cookies[0], &http.Cookie{Name: "app", Value: "a"})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status with cookie wants %d but was %d", http.StatusOK, resp.StatusCode)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read the body: %s", err)
+		}
+		if want := "app=a"; string(b) != want {
+			t.Errorf("upstream cookie wants %s but was %s", want, b)
+		}
+	})
+	t.Run("SessionOfMultipleProxies", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer upstream.Close()
+		rpURLA := runReverseProxy(t, upstream, Option{LoginCode: "LOGIN_CODE_A"})
+		rpURLB := runReverseProxy(t, upstream, Option{LoginCode: "LOGIN_CODE_B"})
+		// a browser shares the cookies between the ports of a host
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatalf("could not create a cookie jar: %s", err)
+		}
+		client := &http.Client{Jar: jar}
+		get := func(t *testing.T, u string) int {
+			resp, err := client.Get(u)
+			if err != nil {
+				t.Fatalf("could not send a request: %s", err)
+			}
+			defer resp.Body.Close()
+			return resp.StatusCode
+		}
+		for _, u := range []string{
+			rpURLA.JoinPath(LoginPath).String() + "?code=LOGIN_CODE_A",
+			rpURLB.JoinPath(LoginPath).String() + "?code=LOGIN_CODE_B",
+			rpURLA.String(),
+			rpURLB.String(),
+		} {
+			if code := get(t, u); code != http.StatusOK {
+				t.Errorf("status of %s wants %d but was %d", u, http.StatusOK, code)
+			}
+		}
+	})
+	t.Run("Protection", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, r.URL.Path)
+		}))
+		defer upstream.Close()
+		rpURL := runReverseProxy(t, upstream, Option{})
+		for _, c := range []struct {
+			name   string
+			method string
+			host   string
+			header http.Header
+			want   int
+		}{
+			{name: "Get", method: http.MethodGet, want: http.StatusOK},
+			{name: "Localhost", method: http.MethodGet, host: "localhost:" + rpURL.Port(), want: http.StatusOK},
+			{name: "DNSRebinding", method: http.MethodGet, host: "evil.example.com:" + rpURL.Port(), want: http.StatusForbidden},
+			{name: "SameOriginPost", method: http.MethodPost,
+				header: http.Header{"Origin": {rpURL.Scheme + "://" + rpURL.Host}, "Sec-Fetch-Site": {"same-origin"}},
+				want:   http.StatusOK},
+			{name: "CrossOriginPost", method: http.MethodPost,
+				header: http.Header{"Origin": {"https://evil.example.com"}, "Sec-Fetch-Site": {"cross-site"}},
+				want:   http.StatusForbidden},
+			{name: "CrossOriginWebSocket", method: http.MethodGet,
+				header: http.Header{"Origin": {"https://evil.example.com"}, "Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+				want:   http.StatusForbidden},
+		} {
+			t.Run(c.name, func(t *testing.T) {
+				req, err := http.NewRequest(c.method, rpURL.JoinPath("/index.html").String(), nil)
+				if err != nil {
+					t.Fatalf("could not create a request: %s", err)
+				}
+				if c.host != "" {
+					req.Host = c.host
+				}
+				for k, v := range c.header {
+					req.Header[k] = v
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("could not send a request: %s", err)
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != c.want {
+					t.Errorf("status wants %d but was %d", c.want, resp.StatusCode)
+				}
+			})
+		}
+	})
+	t.Run("TLS", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, r.URL.Path)
+		}))
+		defer upstream.Close()
+		c := &certificate.Certificate{Logger: mock_logger.New(t)}
+		cert, err := c.Load(certificate.Option{CacheDir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("could not load a certificate: %s", err)
+		}
+		rpURL := runReverseProxy(t, upstream, Option{TLSCertificate: cert})
+		if rpURL.Scheme != "https" {
+			t.Errorf("scheme wants https but was %s", rpURL.Scheme)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(cert.Leaf)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		resp, err := client.Get(rpURL.JoinPath("/index.html").String())
+		if err != nil {
+			t.Fatalf("could not send a request: %s", err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read the body: %s", err)
+		}
+		if want := "/index.html"; string(b) != want {
+			t.Errorf("path wants %s but was %s", want, b)
+		}
+	})
+	t.Run("TargetPathPrefix", func(t *testing.T) {
+		const prefix = "/api/v1/namespaces/kube-system/services/http:headlamp:/proxy"
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case prefix + "/login":
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "s", Path: prefix + "/"})
+				http.Redirect(w, r, fmt.Sprintf("http://%s%s/home?q=1", r.Host, prefix), http.StatusFound)
+			default:
+				_, _ = fmt.Fprint(w, r.URL.Path)
+			}
+		}))
+		defer upstream.Close()
+		rpURL := runReverseProxy(t, upstream, Option{TargetPathPrefix: prefix})
+		client := &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+
+		t.Run("AddPrefix", func(t *testing.T) {
+			resp, err := client.Get(rpURL.JoinPath("/index.html").String())
+			if err != nil {
+				t.Fatalf("could not send a request: %s", err)
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("could not read the body: %s", err)
+			}
+			if want := prefix + "/index.html"; string(b) != want {
+				t.Errorf("path wants %s but was %s", want, b)
+			}
+		})
+		t.Run("AlreadyPrefixed", func(t *testing.T) {
+			resp, err := client.Get(rpURL.JoinPath(prefix, "/index.html").String())
+			if err != nil {
+				t.Fatalf("could not send a request: %s", err)
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("could not read the body: %s", err)
+			}
+			if want := prefix + "/index.html"; string(b) != want {
+				t.Errorf("path wants %s but was %s", want, b)
+			}
+		})
+		t.Run("StripPrefixFromResponse", func(t *testing.T) {
+			resp, err := client.Get(rpURL.JoinPath("/login").String())
+			if err != nil {
+				t.Fatalf("could not send a request: %s", err)
+			}
+			defer resp.Body.Close()
+			if want, got := "/home?q=1", resp.Header.Get("Location"); got != want {
+				t.Errorf("Location wants %s but was %s", want, got)
+			}
+			if want, got := "session=s; Path=/", resp.Header.Get("Set-Cookie"); got != want {
+				t.Errorf("Set-Cookie wants %s but was %s", want, got)
+			}
+		})
+	})
+}
@@ -0,0 +1,121 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Route represents a route from the path prefix to a target.
+type Route struct {
+	// PathPrefix is the prefix of the path to match, e.g. /grafana.
+	// The longest prefix is matched, and / matches any path.
+	PathPrefix string
+	// StripPrefix removes the PathPrefix from the path of a request.
+	// It prepends the PathPrefix to the Location and Set-Cookie headers of a response,
+	// so that the browser stays on the route.
+	StripPrefix  bool
+	Transport    http.RoundTripper
+	TargetScheme string
+	TargetHost   string
+	TargetPort   int
+}
+
+type routeHandler struct {
+	pathPrefix  string
+	stripPrefix bool
+	handler     http.Handler
+}
+
+// router forwards a request to the route of the longest path prefix.
+type router struct {
+	routes []routeHandler
+}
+
+func newRouter(routes []Route, headersToStrip []string) *router {
+	var rt router
+	for _, route := range routes {
+		route.PathPrefix = normalizeRoutePrefix(route.PathPrefix)
+		rt.routes = append(rt.routes, routeHandler{
+			pathPrefix:  route.PathPrefix,
+			stripPrefix: route.StripPrefix,
+			handler:     newProxy(route, "", headersToStrip),
+		})
+	}
+	slices.SortStableFunc(rt.routes, func(a, b routeHandler) int {
+		return len(b.pathPrefix) - len(a.pathPrefix)
+	})
+	return &rt
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range rt.routes {
+		if route.pathPrefix != "" && !hasPathPrefix(r.URL.Path, route.pathPrefix) {
+			continue
+		}
+		if route.stripPrefix && route.pathPrefix != "" && r.URL.Path == route.pathPrefix {
+			// redirect to the trailing slash, so that the browser resolves a relative link in the route
+			u := *r.URL
+			u.Path += "/"
+			u.RawPath = ""
+			http.Redirect(w, r, u.RequestURI(), http.StatusFound)
+			return
+		}
+		route.handler.ServeHTTP(w, r)
+		return
+	}
+	errorPage(w, http.StatusNotFound, "No route matches the path.")
+}
+
+// normalizeRoutePrefix returns the prefix without the trailing slash.
+// It returns an empty string for /.
+func normalizeRoutePrefix(prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+// stripRoutePrefix removes the prefix from the path of a request.
+func stripRoutePrefix(u *url.URL, prefix string) {
+	prefix = normalizeRoutePrefix(prefix)
+	if prefix == "" || !hasPathPrefix(u.Path, prefix) {
+		return
+	}
+	u.Path = trimPathPrefix(u.Path, prefix)
+	u.RawPath = ""
+}
+
+// addRoutePrefix prepends the prefix to the Location and Set-Cookie headers of a response.
+// A relative path and the cookie without a path are kept as-is,
+// because the browser resolves them from the URL on the route.
+func addRoutePrefix(r *http.Response, targetHost, prefix string) {
+	prefix = normalizeRoutePrefix(prefix)
+	if prefix == "" {
+		return
+	}
+	if location := r.Header.Get("Location"); location != "" {
+		if u, err := url.Parse(location); err == nil && (u.Host == "" || u.Host == targetHost) && strings.HasPrefix(u.Path, "/") {
+			u.Scheme, u.Host, u.User = "", "", nil
+			u.Path = prefix + u.Path
+			u.RawPath = ""
+			r.Header.Set("Location", u.String())
+		}
+	}
+	cookies := r.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	r.Header.Del("Set-Cookie")
+	for _, v := range cookies {
+		c, err := http.ParseSetCookie(v)
+		if err != nil || !strings.HasPrefix(c.Path, "/") {
+			r.Header.Add("Set-Cookie", v)
+			continue
+		}
+		c.Path = strings.TrimSuffix(prefix+c.Path, "/")
+		r.Header.Add("Set-Cookie", c.String())
+	}
+}
@@ -0,0 +1,124 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func newRoute(t *testing.T, pathPrefix string, stripPrefix bool, upstream *httptest.Server) Route {
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("could not parse the upstream URL: %s", err)
+	}
+	port, err := strconv.Atoi(upstreamURL.Port())
+	if err != nil {
+		t.Fatalf("could not parse the upstream port: %s", err)
+	}
+	return Route{
+		PathPrefix:   pathPrefix,
+		StripPrefix:  stripPrefix,
+		Transport:    http.DefaultTransport,
+		TargetScheme: "http",
+		TargetHost:   upstreamURL.Hostname(),
+		TargetPort:   port,
+	}
+}
+
+func TestReverseProxy_Run_Routes(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/login":
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "s", Path: "/"})
+				http.Redirect(w, r, fmt.Sprintf("http://%s/home?q=1", r.Host), http.StatusFound)
+			default:
+				_, _ = fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+			}
+		}))
+	}
+	grafana := newUpstream("grafana")
+	defer grafana.Close()
+	argocd := newUpstream("argocd")
+	defer argocd.Close()
+	headlamp := newUpstream("headlamp")
+	defer headlamp.Close()
+	rpURL := runReverseProxy(t, headlamp, Option{
+		Routes: []Route{
+			newRoute(t, "/", false, headlamp),
+			newRoute(t, "/grafana/", true, grafana),
+			newRoute(t, "/argocd", false, argocd),
+		},
+	})
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	get := func(t *testing.T, p string) *http.Response {
+		resp, err := client.Get(rpURL.String() + p)
+		if err != nil {
+			t.Fatalf("could not send a request: %s", err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	for p, want := range map[string]string{
+		"/":                    "headlamp /",
+		"/c/main/pods":         "headlamp /c/main/pods",
+		"/grafana/":            "grafana /",
+		"/grafana/d/home":      "grafana /d/home",
+		"/grafanax":            "headlamp /grafanax",
+		"/argocd/":             "argocd /argocd/",
+		"/argocd/applications": "argocd /argocd/applications",
+	} {
+		t.Run(p, func(t *testing.T) {
+			resp := get(t, p)
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("could not read the body: %s", err)
+			}
+			if string(b) != want {
+				t.Errorf("body wants %s but was %s", want, b)
+			}
+		})
+	}
+	t.Run("RedirectToTrailingSlash", func(t *testing.T) {
+		resp := get(t, "/grafana?orgId=1")
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("status wants %d but was %d", http.StatusFound, resp.StatusCode)
+		}
+		if want, got := "/grafana/?orgId=1", resp.Header.Get("Location"); got != want {
+			t.Errorf("Location wants %s but was %s", want, got)
+		}
+	})
+	t.Run("AddPrefixToResponse", func(t *testing.T) {
+		resp := get(t, "/grafana/login")
+		if want, got := "/grafana/home?q=1", resp.Header.Get("Location"); got != want {
+			t.Errorf("Location wants %s but was %s", want, got)
+		}
+		cookies := resp.Cookies()
+		if len(cookies) != 1 || cookies[0].Path != "/grafana" {
+			t.Errorf("cookie path wants /grafana but was %+v", cookies)
+		}
+	})
+}
+
+func TestReverseProxy_Run_Routes_NotFound(t *testing.T) {
+	grafana := httptest.NewServer(http.NotFoundHandler())
+	defer grafana.Close()
+	rpURL := runReverseProxy(t, grafana, Option{
+		Routes: []Route{newRoute(t, "/grafana", true, grafana)},
+	})
+	resp, err := http.Get(rpURL.JoinPath("/other").String())
+	if err != nil {
+		t.Fatalf("could not send a request: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status wants %d but was %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
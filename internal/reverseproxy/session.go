@@ -0,0 +1,206 @@
+package reverseproxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginPath is the path of the launch URL to start a session.
+// The launch URL is LoginPath?code=LOGIN_CODE, and optionally &path=PATH to redirect after login.
+const LoginPath = "/_kauthproxy/login"
+
+// authorizePath is the path on the bound address to issue a login code for a virtual host.
+// The URL is authorizePath?host=HOST&path=PATH.
+const authorizePath = "/_kauthproxy/authorize"
+
+// virtualHostLoginCodeLifetime is the lifetime of a login code issued for a virtual host.
+const virtualHostLoginCodeLifetime = time.Minute
+
+const sessionCookieName = "kauthproxy_session"
+
+// CookieName returns the name of a cookie of the proxy on the port.
+// A browser sends a cookie to any port of the same host,
+// so the name contains the port to avoid a collision between the proxies.
+func CookieName(name, port string) string {
+	if port == "" {
+		return name
+	}
+	return name + "_" + port
+}
+
+// NewLoginCode returns a random code for the launch URL.
+func NewLoginCode() (string, error) {
+	return newRandomString()
+}
+
+func newRandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not read random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// session authenticates the browser by the cookie.
+//
+// The login code can be used only once.
+// When the browser opens the launch URL, it sets the session cookie and redirects to the path or top.
+// Any request without the cookie is rejected,
+// so that the other users or processes on the same host cannot use the credential.
+//
+// In the virtual host mode, a cookie of the bound address is not sent to a virtual host.
+// When the browser opens a virtual host without the cookie, it redirects to authorizePath of the bound address,
+// which issues a login code for the virtual host and redirects back to LoginPath of the virtual host.
+type session struct {
+	handler     http.Handler
+	boundURL    *url.URL
+	virtualHost bool
+	token       string
+	cookieName  string
+
+	mu sync.Mutex
+	// loginCodes maps a login code to the expiry.
+	// The zero time means no expiry.
+	loginCodes map[string]time.Time
+}
+
+func newSession(h http.Handler, loginCode string, boundURL *url.URL, virtualHost bool) (*session, error) {
+	token, err := newRandomString()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate a session token: %w", err)
+	}
+	return &session{
+		handler:     h,
+		boundURL:    boundURL,
+		virtualHost: virtualHost,
+		token:       token,
+		cookieName:  CookieName(sessionCookieName, boundURL.Port()),
+		loginCodes:  map[string]time.Time{loginCode: {}},
+	}, nil
+}
+
+func (s *session) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == LoginPath {
+		s.login(w, r)
+		return
+	}
+	c, err := r.Cookie(s.cookieName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(s.token)) != 1 {
+		if s.virtualHost && r.Method == http.MethodGet && isVirtualHostOf(r.Host, s.boundURL) {
+			u := s.boundURL.JoinPath(authorizePath)
+			u.RawQuery = url.Values{"host": {r.Host}, "path": {r.URL.RequestURI()}}.Encode()
+			http.Redirect(w, r, u.String(), http.StatusFound)
+			return
+		}
+		errorPage(w, http.StatusUnauthorized, "Open the URL shown by kauthproxy in the terminal.")
+		return
+	}
+	if s.virtualHost && r.URL.Path == authorizePath {
+		s.authorize(w, r)
+		return
+	}
+	r = r.Clone(r.Context())
+	RemoveCookie(r, s.cookieName)
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *session) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorPage(w, http.StatusMethodNotAllowed, "Method is not allowed.")
+		return
+	}
+	if !s.consumeLoginCode(r.URL.Query().Get("code")) {
+		errorPage(w, http.StatusUnauthorized, "The URL has been used or is invalid. Restart kauthproxy to get a new URL.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.cookieName,
+		Value:    s.token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   s.boundURL.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, redirectPath(r.URL.Query().Get("path")), http.StatusFound)
+}
+
+// redirectPath returns the path if it is a path on the same origin, or / otherwise.
+func redirectPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/"
+	}
+	return p
+}
+
+// authorize issues a login code for the virtual host, and redirects to the login URL of it.
+func (s *session) authorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorPage(w, http.StatusMethodNotAllowed, "Method is not allowed.")
+		return
+	}
+	host := r.URL.Query().Get("host")
+	if !isVirtualHostOf(host, s.boundURL) {
+		errorPage(w, http.StatusBadRequest, fmt.Sprintf("Host %s is not a virtual host of kauthproxy.", host))
+		return
+	}
+	code, err := newRandomString()
+	if err != nil {
+		errorPage(w, http.StatusInternalServerError, fmt.Sprintf("Could not generate a login code: %s", err))
+		return
+	}
+	s.mu.Lock()
+	s.loginCodes[code] = time.Now().Add(virtualHostLoginCodeLifetime)
+	s.mu.Unlock()
+	u := url.URL{Scheme: s.boundURL.Scheme, Host: host, Path: LoginPath}
+	u.RawQuery = url.Values{"code": {code}, "path": {r.URL.Query().Get("path")}}.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (s *session) consumeLoginCode(code string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var found bool
+	for c, expiry := range s.loginCodes {
+		expired := !expiry.IsZero() && now.After(expiry)
+		if subtle.ConstantTimeCompare([]byte(code), []byte(c)) == 1 {
+			found = !expired
+			delete(s.loginCodes, c)
+		} else if expired {
+			delete(s.loginCodes, c)
+		}
+	}
+	return found
+}
+
+// RemoveCookie removes the cookie from the request,
+// so that a cookie of kauthproxy is not sent to the upstream.
+// It keeps the other cookies as-is, because http.Request.AddCookie would sanitize the values.
+func RemoveCookie(r *http.Request, name string) {
+	lines := r.Header.Values("Cookie")
+	if len(lines) == 0 {
+		return
+	}
+	r.Header.Del("Cookie")
+	for _, line := range lines {
+		var pairs []string
+		for pair := range strings.SplitSeq(line, ";") {
+			pairName, _, _ := strings.Cut(pair, "=")
+			if strings.TrimSpace(pairName) != name {
+				pairs = append(pairs, pair)
+			}
+		}
+		if remaining := strings.TrimSpace(strings.Join(pairs, ";")); remaining != "" {
+			r.Header.Add("Cookie", remaining)
+		}
+	}
+}
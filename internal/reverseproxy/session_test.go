@@ -0,0 +1,60 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestRedirectPath(t *testing.T) {
+	for input, want := range map[string]string{
+		"":                     "/",
+		"/":                    "/",
+		"/c/main/pods":         "/c/main/pods",
+		"/d/home?orgId=1":      "/d/home?orgId=1",
+		"//example.com":        "/",
+		"/\\example.com":       "/",
+		"https://example.com/": "/",
+		"relative":             "/",
+	} {
+		if got := redirectPath(input); got != want {
+			t.Errorf("redirectPath(%q) wants %s but was %s", input, want, got)
+		}
+	}
+}
+
+func TestRemoveCookie(t *testing.T) {
+	for name, c := range map[string]struct {
+		cookies []string
+		want    []string
+	}{
+		"First":  {[]string{"kauthproxy_session_18000=SESSION; app=1"}, []string{"app=1"}},
+		"Middle": {[]string{"a=1; kauthproxy_session_18000=SESSION; b=2"}, []string{"a=1; b=2"}},
+		"Last":   {[]string{"a=1;kauthproxy_session_18000=SESSION"}, []string{"a=1"}},
+		"Only":   {[]string{"kauthproxy_session_18000=SESSION"}, nil},
+		"MultipleHeaders": {
+			[]string{"kauthproxy_session_18000=SESSION", "a=1"},
+			[]string{"a=1"},
+		},
+		"ValueIsKeptAsIs": {
+			[]string{`a=hello world; kauthproxy_session_18000=SESSION; b="quoted"; c=x,y`},
+			[]string{`a=hello world; b="quoted"; c=x,y`},
+		},
+		"SimilarName": {
+			[]string{"kauthproxy_session_18000_x=1; kauthproxy_session_18000=SESSION"},
+			[]string{"kauthproxy_session_18000_x=1"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, cookie := range c.cookies {
+				r.Header.Add("Cookie", cookie)
+			}
+			RemoveCookie(r, "kauthproxy_session_18000")
+			if got := r.Header.Values("Cookie"); !slices.Equal(got, c.want) {
+				t.Errorf("Cookie wants %q but was %q", c.want, got)
+			}
+		})
+	}
+}
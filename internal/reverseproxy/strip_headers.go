@@ -0,0 +1,41 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// DefaultStripHeaders is the headers removed from a request of the client.
+// The transport sets the credential after them,
+// so that a client cannot spoof the identity to the upstream which trusts the headers.
+// A name ending with * matches to the prefix.
+var DefaultStripHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Impersonate-*",
+	"X-Remote-*",
+	"X-Forwarded-*",
+	"X-Real-Ip",
+	"X-Client-Ip",
+	"X-Auth-Request-*",
+	"X-Webauth-*",
+	"Forwarded",
+}
+
+// stripHeaders removes the headers matched to the names.
+func stripHeaders(h http.Header, names []string) {
+	for _, name := range names {
+		prefix, isPrefix := strings.CutSuffix(name, "*")
+		if !isPrefix {
+			h.Del(name)
+			continue
+		}
+		prefix = textproto.CanonicalMIMEHeaderKey(prefix)
+		for key := range h {
+			if strings.HasPrefix(textproto.CanonicalMIMEHeaderKey(key), prefix) {
+				delete(h, key)
+			}
+		}
+	}
+}
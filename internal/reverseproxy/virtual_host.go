@@ -0,0 +1,60 @@
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// VirtualHostOption represents an option of the virtual host mode.
+type VirtualHostOption struct {
+	// Route returns the route to the virtual host of the name,
+	// e.g. grafana.monitoring of grafana.monitoring.localhost.
+	// It is called on each request, and PathPrefix and StripPrefix of the route are ignored.
+	Route func(ctx context.Context, name string) (Route, error)
+}
+
+// virtualHostDomain is the parent domain of the virtual hosts.
+// A browser resolves any subdomain of localhost to the loopback address.
+const virtualHostDomain = "localhost"
+
+// virtualHostName returns the name of the virtual host,
+// e.g. grafana.monitoring of grafana.monitoring.localhost:18000.
+func virtualHostName(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	name, ok := strings.CutSuffix(host, "."+virtualHostDomain)
+	return name, ok && name != ""
+}
+
+// virtualHostRouter forwards a request to the route of the Host header.
+type virtualHostRouter struct {
+	route          func(ctx context.Context, name string) (Route, error)
+	headersToStrip []string
+}
+
+func (vr *virtualHostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := virtualHostName(r.Host)
+	if !ok {
+		port := "PORT"
+		if _, p, err := net.SplitHostPort(r.Host); err == nil {
+			port = p
+		}
+		writePage(w, http.StatusOK, "kauthproxy",
+			fmt.Sprintf("Open http://NAME.NAMESPACE.%s:%s/ to access the service NAME in the namespace NAMESPACE.", virtualHostDomain, port),
+			fmt.Sprintf("If the namespace is omitted, e.g. http://NAME.%s:%s/, the default namespace is used.", virtualHostDomain, port))
+		return
+	}
+	route, err := vr.route(r.Context(), name)
+	if err != nil {
+		writePage(w, http.StatusBadGateway, fmt.Sprintf("%d %s", http.StatusBadGateway, http.StatusText(http.StatusBadGateway)),
+			fmt.Sprintf("Could not forward to %s: %s", name, err))
+		return
+	}
+	route.PathPrefix, route.StripPrefix = "", false
+	newProxy(route, "", vr.headersToStrip).ServeHTTP(w, r)
+}
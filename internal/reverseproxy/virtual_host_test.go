@@ -0,0 +1,134 @@
+package reverseproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestReverseProxy_Run_VirtualHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+	route := newRoute(t, "", false, upstream)
+	rpURL := runReverseProxy(t, upstream, Option{
+		LoginCode: "LOGIN_CODE",
+		VirtualHost: &VirtualHostOption{
+			Route: func(ctx context.Context, name string) (Route, error) {
+				if name != "grafana.monitoring" {
+					return Route{}, errors.New("service not found")
+				}
+				return route, nil
+			},
+		},
+	})
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	// send a request to the reverse proxy with the Host header of the URL
+	get := func(t *testing.T, rawURL string, cookies ...*http.Cookie) *http.Response {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("could not parse the URL: %s", err)
+		}
+		req, err := http.NewRequest(http.MethodGet, rpURL.String()+u.RequestURI(), nil)
+		if err != nil {
+			t.Fatalf("could not create a request: %s", err)
+		}
+		req.Host = u.Host
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("could not send a request: %s", err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+	sessionCookie := func(t *testing.T, resp *http.Response) *http.Cookie {
+		for _, c := range resp.Cookies() {
+			if c.Name == CookieName(sessionCookieName, rpURL.Port()) {
+				return c
+			}
+		}
+		t.Fatalf("response wants the session cookie but was %+v", resp.Cookies())
+		return nil
+	}
+	virtualHost := "grafana.monitoring.localhost:" + rpURL.Port()
+
+	resp := get(t, rpURL.String()+LoginPath+"?code=LOGIN_CODE")
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("status of login wants %d but was %d", http.StatusFound, resp.StatusCode)
+	}
+	boundCookie := sessionCookie(t, resp)
+
+	t.Run("Index", func(t *testing.T) {
+		resp := get(t, rpURL.String(), boundCookie)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status wants %d but was %d", http.StatusOK, resp.StatusCode)
+		}
+	})
+	t.Run("Login", func(t *testing.T) {
+		resp := get(t, "http://"+virtualHost+"/d/home")
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("status without cookie wants %d but was %d", http.StatusFound, resp.StatusCode)
+		}
+		authorizeURL := resp.Header.Get("Location")
+		wantAuthorizeURL := rpURL.JoinPath(authorizePath).String() + "?" +
+			url.Values{"host": {virtualHost}, "path": {"/d/home"}}.Encode()
+		if authorizeURL != wantAuthorizeURL {
+			t.Fatalf("Location wants %s but was %s", wantAuthorizeURL, authorizeURL)
+		}
+		if resp := get(t, authorizeURL); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status of authorize without cookie wants %d but was %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+		resp = get(t, authorizeURL, boundCookie)
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("status of authorize wants %d but was %d", http.StatusFound, resp.StatusCode)
+		}
+		loginURL := resp.Header.Get("Location")
+		resp = get(t, loginURL)
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("status of login wants %d but was %d", http.StatusFound, resp.StatusCode)
+		}
+		if want := "/d/home"; resp.Header.Get("Location") != want {
+			t.Errorf("Location wants %s but was %s", want, resp.Header.Get("Location"))
+		}
+		virtualHostCookie := sessionCookie(t, resp)
+		if resp := get(t, loginURL); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status of used code wants %d but was %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+
+		resp = get(t, "http://"+virtualHost+"/d/home", virtualHostCookie)
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read the body: %s", err)
+		}
+		if want := "/d/home"; string(b) != want {
+			t.Errorf("body wants %s but was %s", want, b)
+		}
+		resp = get(t, "http://unknown.localhost:"+rpURL.Port()+"/", virtualHostCookie)
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("status of unknown service wants %d but was %d", http.StatusBadGateway, resp.StatusCode)
+		}
+	})
+	t.Run("AuthorizeAnotherPort", func(t *testing.T) {
+		resp := get(t, rpURL.JoinPath(authorizePath).String()+"?host=grafana.localhost:1", boundCookie)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status wants %d but was %d", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+	t.Run("DNSRebinding", func(t *testing.T) {
+		resp := get(t, "http://grafana.example.com:"+rpURL.Port()+"/", boundCookie)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("status wants %d but was %d", http.StatusForbidden, resp.StatusCode)
+		}
+	})
+}
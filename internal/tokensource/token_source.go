@@ -0,0 +1,119 @@
+// Package tokensource provides a token to the upstream by other means than the credential of the cluster.
+package tokensource
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"k8s.io/client-go/transport"
+)
+
+// defaultLifetime is the lifetime of a token if it does not have the expiry, such as an opaque token.
+const defaultLifetime = time.Minute
+
+// NewFile returns a TokenSource which reads a token from the file.
+// It reloads the file periodically, so that a rotated token is used.
+func NewFile(name string) transport.ResettableTokenSource {
+	return transport.NewCachedFileTokenSource(name)
+}
+
+// NewCommand returns a TokenSource which runs the command and reads a token from the standard output.
+// The command is run by the shell.
+//
+// It caches the token until the expiry in the JWT claims,
+// or defaultLifetime if the token is not a JWT.
+func NewCommand(command string) transport.ResettableTokenSource {
+	return transport.NewCachedTokenSource(&commandTokenSource{command: command})
+}
+
+// ServiceAccountTokenCreator creates a token of a service account, such as resolver.Interface.
+type ServiceAccountTokenCreator interface {
+	CreateServiceAccountToken(ctx context.Context, namespace, serviceAccountName string, audiences []string, expiration time.Duration) (string, time.Time, error)
+}
+
+// NewServiceAccount returns a TokenSource which creates a token of the service account by the TokenRequest API.
+// It caches the token and creates a new one when 80% of the lifetime has passed.
+func NewServiceAccount(creator ServiceAccountTokenCreator, namespace, name string, audiences []string, expiration time.Duration) transport.ResettableTokenSource {
+	return transport.NewCachedTokenSource(&serviceAccountTokenSource{
+		creator:    creator,
+		namespace:  namespace,
+		name:       name,
+		audiences:  audiences,
+		expiration: expiration,
+	})
+}
+
+type serviceAccountTokenSource struct {
+	creator    ServiceAccountTokenCreator
+	namespace  string
+	name       string
+	audiences  []string
+	expiration time.Duration
+}
+
+func (s *serviceAccountTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	now := time.Now()
+	token, expiry, err := s.creator.CreateServiceAccountToken(ctx, s.namespace, s.name, s.audiences, s.expiration)
+	if err != nil {
+		return nil, err
+	}
+	refreshAt := now.Add(expiry.Sub(now) * 8 / 10)
+	return &oauth2.Token{AccessToken: token, TokenType: "Bearer", Expiry: refreshAt}, nil
+}
+
+type commandTokenSource struct {
+	command string
+}
+
+func (s *commandTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	c := shellCommand(ctx, s.command)
+	c.Stdout, c.Stderr = &stdout, &stderr
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("could not run the token command: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	token := strings.TrimSpace(stdout.String())
+	if token == "" {
+		return nil, fmt.Errorf("the token command returned an empty token")
+	}
+	return &oauth2.Token{AccessToken: token, TokenType: "Bearer", Expiry: expiryOf(token)}, nil
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// expiryOf returns the expiry of the token.
+// The signature is not verified, because the upstream verifies the token.
+func expiryOf(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Now().Add(defaultLifetime)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Now().Add(defaultLifetime)
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Now().Add(defaultLifetime)
+	}
+	return time.Unix(claims.Exp, 0)
+}
@@ -0,0 +1,73 @@
+package tokensource
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNewCommand(t *testing.T) {
+	t.Run("OpaqueToken", func(t *testing.T) {
+		ts := NewCommand("echo YOUR_TOKEN")
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatalf("Token error: %s", err)
+		}
+		if token.AccessToken != "YOUR_TOKEN" {
+			t.Errorf("AccessToken wants YOUR_TOKEN but was %s", token.AccessToken)
+		}
+	})
+	t.Run("CommandError", func(t *testing.T) {
+		ts := NewCommand("echo session expired >&2; exit 1")
+		if _, err := ts.Token(); err == nil {
+			t.Errorf("error wants non-nil but was nil")
+		}
+	})
+}
+
+func TestExpiryOf(t *testing.T) {
+	t.Run("JWT", func(t *testing.T) {
+		exp := time.Now().Add(time.Hour).Truncate(time.Second)
+		payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix())))
+		if got := expiryOf("HEADER." + payload + ".SIGNATURE"); !got.Equal(exp) {
+			t.Errorf("expiry wants %s but was %s", exp, got)
+		}
+	})
+	t.Run("Opaque", func(t *testing.T) {
+		got := expiryOf("YOUR_TOKEN")
+		if got.After(time.Now().Add(defaultLifetime)) {
+			t.Errorf("expiry wants within %s but was %s", defaultLifetime, got)
+		}
+	})
+}
+
+type fakeCreator struct {
+	calls int
+}
+
+func (c *fakeCreator) CreateServiceAccountToken(_ context.Context, namespace, name string, audiences []string, expiration time.Duration) (string, time.Time, error) {
+	c.calls++
+	return fmt.Sprintf("%s/%s/%s/%d", namespace, name, audiences[0], c.calls), time.Now().Add(expiration), nil
+}
+
+func TestNewServiceAccount(t *testing.T) {
+	var creator fakeCreator
+	ts := NewServiceAccount(&creator, "monitoring", "grafana", []string{"grafana"}, time.Hour)
+	for range 2 {
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatalf("Token error: %s", err)
+		}
+		if want := "monitoring/grafana/grafana/1"; token.AccessToken != want {
+			t.Errorf("AccessToken wants %s but was %s", want, token.AccessToken)
+		}
+		if refreshAt := time.Now().Add(48 * time.Minute); token.Expiry.After(refreshAt) {
+			t.Errorf("Expiry wants before %s but was %s", refreshAt, token.Expiry)
+		}
+	}
+	if creator.calls != 1 {
+		t.Errorf("calls wants 1 but was %d", creator.calls)
+	}
+}
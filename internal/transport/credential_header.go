@@ -0,0 +1,70 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// DefaultCredentialHeaderTemplate is the default template of the credential header value.
+const DefaultCredentialHeaderTemplate = "{{.Token}}"
+
+// CredentialHeaderOption represents how to send the token to the upstream.
+type CredentialHeaderOption struct {
+	// Name is the header to send the token, e.g. X-Forwarded-Access-Token.
+	// If empty, it sends the token in the Authorization header.
+	Name string
+	// Template is the value of the header in text/template, e.g. "Bearer {{.Token}}".
+	// Defaults to DefaultCredentialHeaderTemplate.
+	Template string
+	// KeepAuthorization also sends the Authorization header.
+	KeepAuthorization bool
+}
+
+type credentialHeaderTemplateData struct {
+	Token string
+}
+
+// newCredentialHeaderWrapper returns a wrapper which moves the bearer token to the header.
+// It must be the innermost wrapper, so that it sees the Authorization header set by the credential wrappers.
+func newCredentialHeaderWrapper(o CredentialHeaderOption) (func(http.RoundTripper) http.RoundTripper, error) {
+	text := o.Template
+	if text == "" {
+		text = DefaultCredentialHeaderTemplate
+	}
+	tpl, err := template.New("credential-header").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template of the credential header: %w", err)
+	}
+	if err := tpl.Execute(&strings.Builder{}, credentialHeaderTemplateData{}); err != nil {
+		return nil, fmt.Errorf("invalid template of the credential header: %w", err)
+	}
+	return func(base http.RoundTripper) http.RoundTripper {
+		return &credentialHeaderTransport{base: base, o: o, tpl: tpl}
+	}, nil
+}
+
+type credentialHeaderTransport struct {
+	base http.RoundTripper
+	o    CredentialHeaderOption
+	tpl  *template.Template
+}
+
+func (t *credentialHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	var value strings.Builder
+	if err := t.tpl.Execute(&value, credentialHeaderTemplateData{Token: token}); err != nil {
+		return nil, fmt.Errorf("could not render the credential header: %w", err)
+	}
+	// RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	if !t.o.KeepAuthorization {
+		req.Header.Del("Authorization")
+	}
+	req.Header.Set(t.o.Name, value.String())
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/int128/kauthproxy/internal/logger"
+	"k8s.io/client-go/rest"
+)
+
+// retryUnauthorizedTransport retries an idempotent request once if the upstream responds 401.
+// The credential wrappers refresh the token on 401,
+// i.e. the exec plugin is run again and the token source is reset,
+// so that the retry is sent with a new token.
+//
+// If the retry fails again, it logs the hint to fix the credential.
+type retryUnauthorizedTransport struct {
+	base   http.RoundTripper
+	logger logger.Interface
+	hint   string
+	// true if the hint has been logged since the last success
+	warned atomic.Bool
+}
+
+func (t *retryUnauthorizedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !isRetryable(req) {
+		if err == nil && resp.StatusCode != http.StatusUnauthorized {
+			t.warned.Store(false)
+		}
+		return resp, err
+	}
+	retryReq, err := cloneForRetry(req)
+	if err != nil {
+		return resp, nil
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	t.logger.V(1).Infof("retrying %s %s with a new token, because the upstream responded 401", req.Method, req.URL.Path)
+	resp, err = t.base.RoundTrip(retryReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.warned.Store(false)
+		return resp, nil
+	}
+	if !t.warned.Swap(true) {
+		t.logger.Printf("The upstream rejected the token: %s", t.hint)
+	}
+	return resp, nil
+}
+
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func cloneForRetry(req *http.Request) (*http.Request, error) {
+	retryReq := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return retryReq, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retryReq.Body = body
+	return retryReq, nil
+}
+
+// unauthorizedHint returns an actionable hint when the token is rejected.
+func unauthorizedHint(c *rest.Config, o Option) string {
+	if o.TokenSource != nil {
+		return "check the token given by --token-file, --token-command or --as-service-account"
+	}
+	if c.ExecProvider != nil {
+		command := filepath.Base(c.ExecProvider.Command)
+		args := strings.Join(c.ExecProvider.Args, " ")
+		switch {
+		case strings.Contains(args, "oidc"):
+			return "your OIDC session may have expired, run kubectl oidc-login or log in again in the browser"
+		case strings.HasPrefix(command, "aws"):
+			return "your AWS session may have expired, run aws sso login or refresh your AWS credentials"
+		case command == "gke-gcloud-auth-plugin":
+			return "your Google Cloud session may have expired, run gcloud auth login"
+		case command == "kubelogin" || command == "az":
+			return "your Azure session may have expired, run az login"
+		}
+		return "the credential plugin " + command + " returned a token which the upstream does not accept, log in again or check the audience of the upstream"
+	}
+	return "the token in the kubeconfig may have expired or the upstream does not accept it"
+}
@@ -2,11 +2,15 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/google/wire"
+	"github.com/int128/kauthproxy/internal/logger"
+	"golang.org/x/oauth2"
 	"k8s.io/client-go/pkg/apis/clientauthentication"
 	"k8s.io/client-go/plugin/pkg/client/auth/exec"
 	"k8s.io/client-go/rest"
@@ -15,19 +19,80 @@ import (
 
 var Set = wire.NewSet(
 	wire.Value(NewFunc(New)),
+	wire.Value(NewAPIServerFunc(NewAPIServer)),
 )
 
-type NewFunc func(*rest.Config) (http.RoundTripper, error)
+type NewFunc func(*rest.Config, Option) (http.RoundTripper, error)
+
+// Option represents an option of the transport to the upstream.
+type Option struct {
+	// DialContext opens a connection to the upstream.
+	// If nil, it dials the network.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	// CAData is the PEM-encoded CA certificates to verify the upstream.
+	// If nil, it verifies with the system roots.
+	CAData []byte
+	// ServerName is the expected name in the certificate of the upstream.
+	// If empty, it uses the host of the request.
+	ServerName string
+	// Insecure skips the verification of the upstream.
+	Insecure bool
+	// TokenSource provides a token to the upstream instead of the credential of the cluster,
+	// e.g. for a cluster of client certificate authentication.
+	// If it implements transport.ResettableTokenSource, the token is reset on 401 response.
+	TokenSource oauth2.TokenSource
+	// CredentialHeader is the header to send the token.
+	CredentialHeader CredentialHeaderOption
+	// Logger logs the hint if the upstream rejects the token.
+	// If nil, it does not retry on 401 response.
+	Logger logger.Interface
+}
+
+type NewAPIServerFunc func(*rest.Config) (http.RoundTripper, error)
+
+// NewAPIServer returns a RoundTripper to the API server with the credentials of the user.
+func NewAPIServer(c *rest.Config) (http.RoundTripper, error) {
+	t, err := rest.TransportFor(c)
+	if err != nil {
+		return nil, fmt.Errorf("could not create a transport: %w", err)
+	}
+	return t, nil
+}
 
 // New returns a RoundTripper with token support.
-func New(c *rest.Config) (http.RoundTripper, error) {
+func New(c *rest.Config, o Option) (http.RoundTripper, error) {
 	config := &transport.Config{
-		BearerToken:     c.BearerToken,
-		BearerTokenFile: c.BearerTokenFile,
 		TLS: transport.TLSConfig{
-			Insecure: true,
+			CAData:     o.CAData,
+			ServerName: o.ServerName,
+			Insecure:   o.Insecure,
 		},
 	}
+	if o.DialContext != nil {
+		config.DialHolder = &transport.DialHolder{Dial: o.DialContext}
+	}
+	if o.CredentialHeader.Name != "" {
+		// this must be wrapped at first, to see the header set by the credential wrappers
+		wrapper, err := newCredentialHeaderWrapper(o.CredentialHeader)
+		if err != nil {
+			return nil, err
+		}
+		config.Wrap(wrapper)
+	}
+	if o.TokenSource != nil {
+		if ts, ok := o.TokenSource.(transport.ResettableTokenSource); ok {
+			config.Wrap(transport.ResettableTokenSourceWrapTransport(ts))
+		} else {
+			config.Wrap(transport.TokenSourceWrapTransport(o.TokenSource))
+		}
+		return newTransport(c, o, config)
+	}
+	if hasOnlyClientCertificate(c) {
+		return nil, errors.New("the cluster uses client certificate authentication, which cannot be forwarded to the upstream. " +
+			"Provide a token by --token-file, --token-command or --as-service-account")
+	}
+	config.BearerToken = c.BearerToken
+	config.BearerTokenFile = c.BearerTokenFile
 	// see rest.Config#TransportConfig
 	if c.ExecProvider != nil && c.AuthProvider != nil {
 		return nil, errors.New("execProvider and authProvider cannot be used in combination")
@@ -56,9 +121,23 @@ func New(c *rest.Config) (http.RoundTripper, error) {
 		}
 		config.Wrap(provider.WrapTransport)
 	}
+	return newTransport(c, o, config)
+}
+
+func newTransport(c *rest.Config, o Option, config *transport.Config) (http.RoundTripper, error) {
 	t, err := transport.New(config)
 	if err != nil {
 		return nil, fmt.Errorf("could not create a transport: %w", err)
 	}
-	return t, nil
+	if o.Logger == nil {
+		return t, nil
+	}
+	return &retryUnauthorizedTransport{base: t, logger: o.Logger, hint: unauthorizedHint(c, o)}, nil
+}
+
+// hasOnlyClientCertificate returns true if the config has a client certificate but no token.
+func hasOnlyClientCertificate(c *rest.Config) bool {
+	hasCert := len(c.CertData) > 0 || c.CertFile != ""
+	hasToken := c.BearerToken != "" || c.BearerTokenFile != "" || c.ExecProvider != nil || c.AuthProvider != nil
+	return hasCert && !hasToken
 }
@@ -0,0 +1,170 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/int128/kauthproxy/internal/logger/mock_logger"
+	"golang.org/x/oauth2"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+)
+
+func TestNew(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "Authorization=%s,X-Forwarded-Access-Token=%s",
+			r.Header.Get("Authorization"), r.Header.Get("X-Forwarded-Access-Token"))
+	}))
+	defer upstream.Close()
+	get := func(t *testing.T, rt http.RoundTripper) string {
+		resp, err := (&http.Client{Transport: rt}).Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("could not send a request: %s", err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read the body: %s", err)
+		}
+		return string(b)
+	}
+
+	t.Run("BearerToken", func(t *testing.T) {
+		rt, err := New(&rest.Config{BearerToken: "YOUR_TOKEN"}, Option{})
+		if err != nil {
+			t.Fatalf("New error: %s", err)
+		}
+		if want, got := "Authorization=Bearer YOUR_TOKEN,X-Forwarded-Access-Token=", get(t, rt); got != want {
+			t.Errorf("headers wants %s but was %s", want, got)
+		}
+	})
+	t.Run("TokenSource", func(t *testing.T) {
+		rt, err := New(&rest.Config{TLSClientConfig: rest.TLSClientConfig{CertData: []byte("CERT")}}, Option{
+			TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "SOURCE_TOKEN"}),
+		})
+		if err != nil {
+			t.Fatalf("New error: %s", err)
+		}
+		if want, got := "Authorization=Bearer SOURCE_TOKEN,X-Forwarded-Access-Token=", get(t, rt); got != want {
+			t.Errorf("headers wants %s but was %s", want, got)
+		}
+	})
+	t.Run("OnlyClientCertificate", func(t *testing.T) {
+		if _, err := New(&rest.Config{TLSClientConfig: rest.TLSClientConfig{CertData: []byte("CERT")}}, Option{}); err == nil {
+			t.Errorf("error wants non-nil but was nil")
+		}
+	})
+	t.Run("CredentialHeader", func(t *testing.T) {
+		rt, err := New(&rest.Config{BearerToken: "YOUR_TOKEN"}, Option{
+			CredentialHeader: CredentialHeaderOption{Name: "X-Forwarded-Access-Token"},
+		})
+		if err != nil {
+			t.Fatalf("New error: %s", err)
+		}
+		if want, got := "Authorization=,X-Forwarded-Access-Token=YOUR_TOKEN", get(t, rt); got != want {
+			t.Errorf("headers wants %s but was %s", want, got)
+		}
+	})
+	t.Run("CredentialHeaderWithTemplate", func(t *testing.T) {
+		rt, err := New(&rest.Config{BearerToken: "YOUR_TOKEN"}, Option{
+			CredentialHeader: CredentialHeaderOption{
+				Name:              "X-Forwarded-Access-Token",
+				Template:          "Token {{.Token}}",
+				KeepAuthorization: true,
+			},
+		})
+		if err != nil {
+			t.Fatalf("New error: %s", err)
+		}
+		if want, got := "Authorization=Bearer YOUR_TOKEN,X-Forwarded-Access-Token=Token YOUR_TOKEN", get(t, rt); got != want {
+			t.Errorf("headers wants %s but was %s", want, got)
+		}
+	})
+	t.Run("InvalidTemplate", func(t *testing.T) {
+		_, err := New(&rest.Config{BearerToken: "YOUR_TOKEN"}, Option{
+			CredentialHeader: CredentialHeaderOption{Name: "X-Token", Template: "{{.Unknown}}"},
+		})
+		if err == nil {
+			t.Errorf("error wants non-nil but was nil")
+		}
+	})
+}
+
+// countingTokenSource returns a new token after reset.
+// A token is issued at the fixed time, so that it is always older than a request.
+type countingTokenSource struct {
+	mu     sync.Mutex
+	count  int
+	tok    *oauth2.Token
+	issued time.Time
+}
+
+var _ transport.ResettableTokenSource = &countingTokenSource{}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok == nil {
+		s.count++
+		s.tok = &oauth2.Token{AccessToken: fmt.Sprintf("TOKEN_%d", s.count)}
+		s.issued = time.Unix(0, 0)
+	}
+	return s.tok, nil
+}
+
+func (s *countingTokenSource) ResetTokenOlderThan(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.issued.Before(t) {
+		s.tok = nil
+	}
+}
+
+func TestNew_RetryUnauthorized(t *testing.T) {
+	// accept only the second token
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer TOKEN_2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = fmt.Fprint(w, "OK")
+	}))
+	defer upstream.Close()
+	newTransport := func(t *testing.T) http.RoundTripper {
+		rt, err := New(&rest.Config{}, Option{
+			TokenSource: &countingTokenSource{},
+			Logger:      mock_logger.New(t),
+		})
+		if err != nil {
+			t.Fatalf("New error: %s", err)
+		}
+		return rt
+	}
+
+	t.Run("Idempotent", func(t *testing.T) {
+		resp, err := (&http.Client{Transport: newTransport(t)}).Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("could not send a request: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status wants %d but was %d", http.StatusOK, resp.StatusCode)
+		}
+	})
+	t.Run("NotIdempotent", func(t *testing.T) {
+		resp, err := (&http.Client{Transport: newTransport(t)}).Post(upstream.URL, "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatalf("could not send a request: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status wants %d but was %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+}